@@ -0,0 +1,76 @@
+package list
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeAddress returns the form in which an address is stored and compared.
+// The local part is normalized to Unicode NFC. Only its ASCII letters are
+// lowercased, since case folding of other characters is up to the receiving
+// server (RFC 6531). Domains are converted to lowercase U-labels (RFC 5891), so
+// the same domain written as A-labels or U-labels gives the same address.
+func normalizeAddress(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return "", fmt.Errorf("mail: missing @ in address %s", address)
+	}
+
+	local := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, norm.NFC.String(address[:i]))
+
+	domain, err := idna.Lookup.ToUnicode(address[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("mail: invalid domain in address %s: %s", address, err.Error())
+	}
+
+	return local + "@" + domain, nil
+}
+
+// canonicalAddress normalizes an address for comparison, falling back to lowercase if it is invalid
+func canonicalAddress(address string) string {
+	normalized, err := normalizeAddress(address)
+	if err != nil {
+		return strings.ToLower(address)
+	}
+	return normalized
+}
+
+// CanonicalAddress returns the form in which addresses are stored, like canonicalAddress
+func CanonicalAddress(address string) string {
+	return canonicalAddress(address)
+}
+
+// parseAddress parses a single address, and returns its normalized form
+func parseAddress(address string) (string, error) {
+	obj, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return normalizeAddress(obj.Address)
+}
+
+// asciiAddress returns an address with its domain converted to A-labels, and
+// reports whether the result is ASCII, i.e. whether it can be used without SMTPUTF8
+func asciiAddress(address string) (string, bool) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return address, isASCII(address)
+	}
+
+	domain, err := idna.Lookup.ToASCII(address[i+1:])
+	if err != nil {
+		return address, isASCII(address)
+	}
+
+	address = address[:i] + "@" + domain
+	return address, isASCII(address)
+}
@@ -0,0 +1,255 @@
+package list
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// MaxARCInstances is the maximum number of ARC sets in a message (RFC 8617)
+const MaxARCInstances = 50
+
+// An arcSet holds what is needed to add an ARC set to a message when it is sent
+type arcSet struct {
+	// Instance of the new set
+	Instance int
+	// Results are the authentication results computed on receipt
+	Results string
+	// ChainValidation is the validation status of the existing chain: none, pass or fail
+	ChainValidation string
+}
+
+// arcHeaders groups the ARC header fields of a message by instance
+type arcHeaders map[int]map[string]string
+
+// parseARCHeaders collects the ARC header fields of a message. It returns
+// an error if the sets are not numbered from 1 or are incomplete.
+func parseARCHeaders(fields []string) (arcHeaders, error) {
+	var err error
+	sets := arcHeaders{}
+	for _, field := range fields {
+		name := strings.ToLower(fieldName(field))
+		switch name {
+		case "arc-seal", "arc-message-signature", "arc-authentication-results":
+		default:
+			continue
+		}
+
+		value := field[strings.Index(field, ":")+1:]
+		tag := strings.SplitN(value, ";", 2)[0]
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) != "i" {
+			err = fmt.Errorf("Missing instance in %s", fieldName(field))
+			continue
+		}
+		instance, convErr := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if convErr != nil || instance < 1 || instance > MaxARCInstances {
+			err = fmt.Errorf("Invalid instance in %s", fieldName(field))
+			continue
+		}
+
+		if sets[instance] == nil {
+			sets[instance] = map[string]string{}
+		}
+		if _, ok := sets[instance][name]; ok {
+			err = fmt.Errorf("Duplicate %s for instance %d", fieldName(field), instance)
+		}
+		sets[instance][name] = field
+	}
+	if err != nil {
+		return sets, err
+	}
+
+	for instance := 1; instance <= sets.last(); instance++ {
+		if len(sets[instance]) != 3 {
+			return sets, fmt.Errorf("Incomplete ARC set %d", instance)
+		}
+	}
+
+	return sets, nil
+}
+
+// last returns the highest instance
+func (sets arcHeaders) last() int {
+	n := 0
+	for instance := range sets {
+		if instance > n {
+			n = instance
+		}
+	}
+	return n
+}
+
+// validateARC validates the ARC chain of a serialized message (RFC 8617 section 5.2),
+// and returns its instance count and validation status
+func validateARC(resolver Resolver, data []byte) (int, string, error) {
+	fields, body := splitMessage(data)
+
+	sets, err := parseARCHeaders(fields)
+	n := sets.last()
+	if err != nil {
+		return n, "fail", err
+	}
+	if n == 0 {
+		return 0, "none", nil
+	}
+
+	// Check the chain validation status recorded by every hop
+	for instance := n; instance >= 1; instance-- {
+		tags := parseTags(sets[instance]["arc-seal"][strings.Index(sets[instance]["arc-seal"], ":")+1:])
+		expected := "pass"
+		if instance == 1 {
+			expected = "none"
+		}
+		if tags["cv"] != expected {
+			return n, "fail", fmt.Errorf("ARC set %d has cv=%s", instance, tags["cv"])
+		}
+	}
+
+	// Only the most recent message signature can be expected to be valid
+	_, err = verifyMessageSignature(resolver, sets[n]["arc-message-signature"], fields, body)
+	if err != nil {
+		return n, "fail", fmt.Errorf("ARC message signature %d: %s", n, err.Error())
+	}
+
+	for instance := n; instance >= 1; instance-- {
+		err = verifySeal(resolver, sets, instance)
+		if err != nil {
+			return n, "fail", fmt.Errorf("ARC seal %d: %s", instance, err.Error())
+		}
+	}
+
+	return n, "pass", nil
+}
+
+// sealData returns the data signed by the ARC seal of an instance, without the
+// seal itself. If the chain failed, the seal only covers its own set.
+func sealData(sets arcHeaders, instance int, cv string) []byte {
+	first := 1
+	if cv == "fail" {
+		first = instance
+	}
+
+	data := []byte{}
+	for i := first; i <= instance; i++ {
+		data = append(data, relaxedHeader(sets[i]["arc-authentication-results"])+"\r\n"...)
+		data = append(data, relaxedHeader(sets[i]["arc-message-signature"])+"\r\n"...)
+		if i < instance {
+			data = append(data, relaxedHeader(sets[i]["arc-seal"])+"\r\n"...)
+		}
+	}
+	return data
+}
+
+// verifySeal verifies the ARC seal of an instance
+func verifySeal(resolver Resolver, sets arcHeaders, instance int) error {
+	seal := sets[instance]["arc-seal"]
+	tags := parseTags(seal[strings.Index(seal, ":")+1:])
+	for _, tag := range []string{"a", "b", "d", "s"} {
+		if tags[tag] == "" {
+			return fmt.Errorf("Missing tag %s=", tag)
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(stripSpace(tags["b"]))
+	if err != nil {
+		return err
+	}
+
+	key, err := dkimPublicKey(resolver, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	hash.Write(sealData(sets, instance, tags["cv"]))
+	hash.Write([]byte(relaxedHeader(withoutSignature(seal))))
+
+	return verifyHash(key, tags["a"], hash.Sum(nil), signature)
+}
+
+// seal adds a new ARC set to the header of a message (RFC 8617 section 5.1)
+func (signer *dkimSigner) seal(header []byte, bodyHash string, set *arcSet) ([]byte, error) {
+	if set.Instance > MaxARCInstances {
+		return header, nil
+	}
+
+	fields, _ := splitMessage(header)
+	sets, _ := parseARCHeaders(fields)
+
+	results := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s", set.Instance, set.Results)
+
+	// The message signature must not cover ARC header fields
+	headers := []string{}
+	for _, header := range signer.headers {
+		if !strings.HasPrefix(strings.ToLower(header), "arc-") {
+			headers = append(headers, header)
+		}
+	}
+	headers = append(headers, "DKIM-Signature")
+	messageSigner := *signer
+	messageSigner.headers = headers
+
+	signature, err := messageSigner.messageSignature("ARC-Message-Signature", fmt.Sprintf("i=%d", set.Instance), fields, bodyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	sets[set.Instance] = map[string]string{
+		"arc-authentication-results": results,
+		"arc-message-signature":      signature,
+	}
+
+	hash := sha256.New()
+	hash.Write(sealData(sets, set.Instance, set.ChainValidation))
+	seal, err := signer.sign(hash, fmt.Sprintf("ARC-Seal: i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tb=",
+		set.Instance, signer.algorithm(), set.ChainValidation, signer.domain, signer.selector))
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(seal+"\r\n"+signature+"\r\n"+results+"\r\n"), header...), nil
+}
+
+// prepareARC validates the ARC chain of a received message, and returns the ARC set to add to the copies sent to the list
+func (b *bot) prepareARC(list *list, msg *Message) *arcSet {
+	authservID := b.authservID()
+
+	n, cv, err := validateARC(b.Resolver, msg.received())
+	if err != nil {
+		log.Printf("ARC_VALIDATION_FAILED listAddress=%q Id=%q From=%q Error=%s\n", list.Address, msg.Address, msg.From, err.Error())
+	}
+
+	// Authentication-Results of earlier hops can be forged, only our own checks are recorded
+	results := append(msg.auth.results(), "arc="+cv)
+
+	return &arcSet{
+		Instance:        n + 1,
+		Results:         authservID + ";\r\n\t" + strings.Join(results, ";\r\n\t"),
+		ChainValidation: cv,
+	}
+}
+
+// authservID returns the identifier of our authentication results
+func (b *bot) authservID() string {
+	if b.AuthservID != "" {
+		return b.AuthservID
+	}
+	return b.CommandAddress[strings.LastIndex(b.CommandAddress, "@")+1:]
+}
+
+// seal adds an ARC set to the header of a message, if a DKIM key is configured
+func (config Config) seal(header []byte, bodyHash string, set *arcSet) ([]byte, error) {
+	signer, err := config.dkimSigner()
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return header, nil
+	}
+
+	return signer.seal(header, bodyHash, set)
+}
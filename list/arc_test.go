@@ -0,0 +1,34 @@
+package list
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrepareARCResults(t *testing.T) {
+	b := NewBot(newMemoryBackend(Config{CommandAddress: "lists@example.com"}))
+	b.Resolver = stubResolver{}
+
+	list := &list{Definition: Definition{Address: "list@example.com"}}
+
+	msg := &Message{}
+	err := msg.parse([]byte("Authentication-Results: example.com; dkim=pass header.d=bank.example\r\n" +
+		"From: bob@example.net\r\nSubject: Hello\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.auth = &authentication{SPF: SPFPass, SPFDomain: "example.net"}
+
+	set := b.prepareARC(list, msg)
+	if want := "example.com;\r\n\tspf=pass smtp.mailfrom=example.net;\r\n\tarc=none"; set.Results != want {
+		t.Errorf("got results %q, want %q", set.Results, want)
+	}
+
+	// Approved messages are sealed with the results recorded when they were held
+	msg.auth = &authentication{recorded: []string{"dkim=pass header.d=example.net"}}
+
+	set = b.prepareARC(list, msg)
+	if strings.Contains(set.Results, "bank.example") || !strings.Contains(set.Results, "dkim=pass header.d=example.net") {
+		t.Errorf("got results %q", set.Results)
+	}
+}
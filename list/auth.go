@@ -0,0 +1,150 @@
+package list
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// An Envelope holds the SMTP session details of a received message, as passed by the MTA
+type Envelope struct {
+	// Sender is the envelope sender (MAIL FROM)
+	Sender string
+	// ClientIP is the address of the SMTP client
+	ClientIP string
+	// Helo is the name the SMTP client announced in HELO or EHLO
+	Helo string
+}
+
+// A dkimResult is the outcome of the verification of a single DKIM signature
+type dkimResult struct {
+	Domain string
+	Result string
+	Error  error
+	// Headers are the lowercase names of the signed header fields
+	Headers []string
+}
+
+// An authentication holds the results of the authentication checks of a received message
+type authentication struct {
+	DKIM      []dkimResult
+	SPF       string
+	SPFDomain string
+	// recorded holds the results of earlier checks, e.g. of a held message, instead of the above
+	recorded []string
+}
+
+// authenticate verifies the DKIM signatures of a received message, and checks SPF if
+// the envelope is known
+func authenticate(resolver Resolver, data []byte, envelope Envelope) *authentication {
+	auth := &authentication{}
+
+	fields, body := splitMessage(data)
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			continue
+		}
+
+		result := dkimResult{Result: "pass"}
+		tags, err := verifyMessageSignature(resolver, field, fields, body)
+		if err == nil && tags["v"] != "1" {
+			err = fmt.Errorf("Unsupported version %s", tags["v"])
+		}
+		if err == nil && !containsFold(strings.Split(stripSpace(tags["h"]), ":"), "from") {
+			err = fmt.Errorf("The From header is not signed")
+		}
+		if err == errPartialBody {
+			result.Result, result.Error = "neutral", err
+		} else if err != nil {
+			result.Result, result.Error = "fail", err
+		}
+		result.Domain = strings.ToLower(tags["d"])
+		result.Headers = strings.Split(strings.ToLower(stripSpace(tags["h"])), ":")
+
+		auth.DKIM = append(auth.DKIM, result)
+	}
+
+	ip := net.ParseIP(envelope.ClientIP)
+	if ip == nil {
+		return auth
+	}
+
+	auth.SPFDomain = envelope.Helo
+	if i := strings.LastIndex(envelope.Sender, "@"); i >= 0 {
+		auth.SPFDomain = envelope.Sender[i+1:]
+	}
+	auth.SPFDomain = strings.ToLower(auth.SPFDomain)
+
+	if auth.SPFDomain == "" {
+		auth.SPF = SPFNone
+		return auth
+	}
+
+	auth.SPF, _ = checkSPF(resolver, ip, envelope.Sender, envelope.Helo)
+	return auth
+}
+
+// aligned checks whether the domain of an address is authenticated by a valid
+// DKIM signature that covers the given header fields, or SPF. Alignment is
+// relaxed, but only parent domains are considered part of the same organization.
+func (auth *authentication) aligned(address string, headers ...string) bool {
+	if auth == nil {
+		return false
+	}
+
+	// Authenticated domains are A-labels
+	address, _ = asciiAddress(address)
+	domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+
+	for _, result := range auth.DKIM {
+		if result.Result == "pass" && sameOrganization(domain, result.Domain) && signed(result.Headers, headers) {
+			return true
+		}
+	}
+
+	return auth.SPF == SPFPass && sameOrganization(domain, auth.SPFDomain)
+}
+
+// signed checks whether all header fields are in the signed header fields
+func signed(signedHeaders []string, headers []string) bool {
+	for _, header := range headers {
+		if !containsFold(signedHeaders, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameOrganization checks whether one domain is equal to, or a subdomain of the other
+func sameOrganization(a string, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// results returns the results in the format of Authentication-Results (RFC 8601)
+func (auth *authentication) results() []string {
+	results := []string{}
+	if auth == nil {
+		return results
+	}
+	if auth.recorded != nil {
+		return append(results, auth.recorded...)
+	}
+
+	for _, result := range auth.DKIM {
+		results = append(results, fmt.Sprintf("dkim=%s header.d=%s", result.Result, result.Domain))
+	}
+	if auth.SPF != "" {
+		results = append(results, fmt.Sprintf("spf=%s smtp.mailfrom=%s", auth.SPF, auth.SPFDomain))
+	}
+
+	return results
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package list
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// signWithLength signs a message with an l= tag covering the first length bytes of the canonical body
+func signWithLength(t *testing.T, signer *dkimSigner, message string, length int64) string {
+	fields, body := splitMessage([]byte(message))
+
+	hash := sha256.New()
+	signed := writeSignedHeaders(hash, fields, signer.headers, "relaxed")
+
+	bodyHash := sha256.New()
+	writeCanonicalBody(&limitedWriter{w: bodyHash, n: length}, body, "relaxed")
+
+	signature, err := signer.sign(hash, fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; l=%d; h=%s; bh=%s; b=",
+		signer.algorithm(), signer.domain, signer.selector, length, strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash.Sum(nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature + "\r\n" + message
+}
+
+func TestAuthenticate(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Seed)
+	signer := &dkimSigner{domain: "football.example.com", selector: "brisbane", key: ed25519.NewKeyFromSeed(seed), headers: []string{"From", "Subject"}}
+	unsigned := &dkimSigner{domain: "football.example.com", selector: "brisbane", key: signer.key, headers: []string{"Subject"}}
+	fromOnly := &dkimSigner{domain: "football.example.com", selector: "brisbane", key: signer.key, headers: []string{"From"}}
+
+	resolver := stubResolver{
+		txt: map[string][]string{
+			"brisbane._domainkey.football.example.com": rfc8463Resolver.txt["brisbane._domainkey.football.example.com"],
+			"example.net": {"v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+	}
+
+	message := "From: Joe <joe@football.example.com>\r\nSubject: Is dinner ready?\r\n\r\nHi.\r\n"
+	bodyLength := int64(len("Hi.\r\n"))
+
+	sign := func(signer *dkimSigner, message string) string {
+		fields, body := splitMessage([]byte(message))
+		signature, err := signer.messageSignature("DKIM-Signature", "v=1", fields, relaxedBodyHash(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature + "\r\n" + message
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		result  string
+		aligned bool
+		command bool
+	}{
+		{"signed", sign(signer, message), "pass", true, true},
+		{"tampered", strings.Replace(sign(signer, message), "Hi.", "Bye.", 1), "fail", false, false},
+		{"from not signed", sign(unsigned, message), "fail", false, false},
+		{"subject not signed", sign(fromOnly, message), "pass", true, false},
+		{"full length", signWithLength(t, signer, message, bodyLength), "pass", true, true},
+		{"partial length", signWithLength(t, signer, message+"Click here.\r\n", bodyLength), "neutral", false, false},
+		{"length exceeds body", signWithLength(t, signer, message, bodyLength+1), "fail", false, false},
+	}
+
+	for _, test := range tests {
+		auth := authenticate(resolver, []byte(test.data), Envelope{})
+		if len(auth.DKIM) != 1 {
+			t.Fatalf("%s: %d DKIM results", test.name, len(auth.DKIM))
+		}
+		if auth.DKIM[0].Result != test.result {
+			t.Errorf("%s: result %s, want %s (%v)", test.name, auth.DKIM[0].Result, test.result, auth.DKIM[0].Error)
+		}
+		if auth.DKIM[0].Domain != "football.example.com" {
+			t.Errorf("%s: domain %s", test.name, auth.DKIM[0].Domain)
+		}
+		if aligned := auth.aligned("joe@football.example.com"); aligned != test.aligned {
+			t.Errorf("%s: aligned %v, want %v", test.name, aligned, test.aligned)
+		}
+		if command := auth.aligned("joe@football.example.com", "subject"); command != test.command {
+			t.Errorf("%s: aligned with subject %v, want %v", test.name, command, test.command)
+		}
+		if auth.SPF != "" {
+			t.Errorf("%s: SPF checked without envelope", test.name)
+		}
+	}
+
+	// Subdomains and parent domains are aligned, other domains are not
+	auth := authenticate(resolver, []byte(sign(signer, message)), Envelope{})
+	for address, aligned := range map[string]bool{
+		"joe@mail.football.example.com": true,
+		"joe@example.com":               true,
+		"joe@basketball.example.com":    false,
+		"joe@football.example.net":      false,
+	} {
+		if auth.aligned(address) != aligned {
+			t.Errorf("aligned(%s) = %v, want %v", address, !aligned, aligned)
+		}
+	}
+
+	// The bottom instance of a field is signed, so a prepended field leaves the signature
+	// valid. Such messages are refused, as the top instance would be used.
+	for _, field := range []string{"Subject: unsubscribe list@example.com", "From: boss@football.example.com", "Sender: boss@example.com\r\nSender: joe@example.com", "Reply-To: a@example.com\r\nReply-To: b@example.com"} {
+		forged := field + "\r\n" + sign(signer, message)
+		if err := (&Message{}).parse([]byte(forged)); err == nil {
+			t.Errorf("parsed a message with a prepended %q", field)
+		}
+	}
+	if err := (&Message{}).parse([]byte(sign(signer, message))); err != nil {
+		t.Errorf("parse failed: %s", err.Error())
+	}
+
+	// SPF is checked if the envelope is known
+	envelope := Envelope{Sender: "bounces@example.net", ClientIP: net.ParseIP("192.0.2.1").String(), Helo: "mx.example.net"}
+	auth = authenticate(resolver, []byte(message), envelope)
+	if len(auth.DKIM) != 0 || auth.SPF != SPFPass || auth.SPFDomain != "example.net" {
+		t.Errorf("SPF: unexpected results %v", auth.results())
+	}
+	if !auth.aligned("joe@lists.example.net") || auth.aligned("joe@football.example.com") {
+		t.Errorf("SPF: unexpected alignment")
+	}
+
+	envelope.ClientIP = "198.51.100.1"
+	auth = authenticate(resolver, []byte(message), envelope)
+	if auth.SPF != SPFFail || auth.aligned("joe@example.net") {
+		t.Errorf("SPF: unexpected results %v", auth.results())
+	}
+}
@@ -1,6 +1,7 @@
 package list
 
 import (
+	"strings"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -21,10 +22,28 @@ type Backend interface {
 	LookupList(string) (*Definition, error)
 	ListSubscribe(Definition, string) error
 	ListUnsubscribe(Definition, string) error
+	ListSetMode(Definition, string, DeliveryMode) error
 	ListSetBounce(Definition, string, uint16, time.Time) error
 	ListSubscribers(Definition) ([]Subscription, error)
 	ListIsSubscribed(Definition, string) (*Subscription, error)
 	ListArchive(Definition, *Message) error
+	ListArchived(Definition, time.Time, time.Time) ([]ArchivedMessage, error)
+	ListLastDigest(Definition) (time.Time, error)
+	ListSetLastDigest(Definition, time.Time) error
+	ListAddPending(Definition, string, string, time.Time) error
+	ListPending(Definition, string) (*PendingSubscription, error)
+	LookupPending(string) (*PendingSubscription, error)
+	DeletePending(string) error
+	ListHold(Definition, HeldMessage) error
+	LookupHeld(string) (*HeldMessage, error)
+	DeleteHeld(string) error
+	AddReply(string, time.Time) error
+	CountReplies(string, time.Time) (int, error)
+	ListEnqueue(Definition, QueuedMessage) error
+	Queued() ([]QueuedMessage, error)
+	UpdateQueued(string, QueuedDelivery) error
+	DeleteQueued(string, string) error
+	PurgeQueue(time.Time) error
 }
 
 // A BotFactory creates a Bot based on the parsed context - before applying other actions
@@ -41,6 +60,14 @@ func NewBotFactory(backend Backend) botFactory {
 func NewBot(backend Backend) *bot {
 	b := &bot{}
 	b.Config = backend.Config()
+	b.Resolver = netResolver{}
+
+	// Compare admins in the same form as the addresses of senders
+	admins := []string{}
+	for _, address := range b.AdminAddresses {
+		admins = append(admins, canonicalAddress(strings.TrimSpace(address)))
+	}
+	b.AdminAddresses = admins
 
 	b.Lists = func() ([]*list, error) {
 		defs, err := backend.Lists()
@@ -72,6 +99,36 @@ func NewBot(backend Backend) *bot {
 		}
 		return NewList(backend, *def), err
 	}
+	b.LookupPending = func(t string) (*PendingSubscription, error) {
+		return backend.LookupPending(t)
+	}
+	b.DeletePending = func(t string) error {
+		return backend.DeletePending(t)
+	}
+	b.LookupHeld = func(t string) (*HeldMessage, error) {
+		return backend.LookupHeld(t)
+	}
+	b.DeleteHeld = func(t string) error {
+		return backend.DeleteHeld(t)
+	}
+	b.AddReply = func(a string, t time.Time) error {
+		return backend.AddReply(a, t)
+	}
+	b.CountReplies = func(a string, t time.Time) (int, error) {
+		return backend.CountReplies(a, t)
+	}
+	b.Queued = func() ([]QueuedMessage, error) {
+		return backend.Queued()
+	}
+	b.UpdateQueued = func(id string, d QueuedDelivery) error {
+		return backend.UpdateQueued(id, d)
+	}
+	b.DeleteQueued = func(id string, r string) error {
+		return backend.DeleteQueued(id, r)
+	}
+	b.PurgeQueue = func(t time.Time) error {
+		return backend.PurgeQueue(t)
+	}
 
 	return b
 }
@@ -84,9 +141,18 @@ func NewList(backend Backend, definition Definition) *list {
 	l.Subscribe = func(a string) error {
 		return backend.ListSubscribe(definition, a)
 	}
+	l.AddPending = func(a string, t string, e time.Time) error {
+		return backend.ListAddPending(definition, a, t, e)
+	}
+	l.Pending = func(a string) (*PendingSubscription, error) {
+		return backend.ListPending(definition, a)
+	}
 	l.Unsubscribe = func(a string) error {
 		return backend.ListUnsubscribe(definition, a)
 	}
+	l.SetMode = func(a string, m DeliveryMode) error {
+		return backend.ListSetMode(definition, a, m)
+	}
 	l.SetBounce = func(a string, c uint16, t time.Time) error {
 		return backend.ListSetBounce(definition, a, c, t)
 	}
@@ -99,6 +165,21 @@ func NewList(backend Backend, definition Definition) *list {
 	l.Archive = func(msg *Message) error {
 		return backend.ListArchive(definition, msg)
 	}
+	l.Hold = func(h HeldMessage) error {
+		return backend.ListHold(definition, h)
+	}
+	l.Archived = func(since time.Time, until time.Time) ([]ArchivedMessage, error) {
+		return backend.ListArchived(definition, since, until)
+	}
+	l.LastDigest = func() (time.Time, error) {
+		return backend.ListLastDigest(definition)
+	}
+	l.SetLastDigest = func(t time.Time) error {
+		return backend.ListSetLastDigest(definition, t)
+	}
+	l.Enqueue = func(q QueuedMessage) error {
+		return backend.ListEnqueue(definition, q)
+	}
 
 	return l
 }
@@ -0,0 +1,292 @@
+package list
+
+import (
+	"fmt"
+	"time"
+)
+
+// memoryBackend is a Backend that keeps everything in memory, for tests
+type memoryBackend struct {
+	config        Config
+	lists         []Definition
+	subscriptions map[string][]Subscription
+	lastDigests   map[string]time.Time
+	archive       map[string][]ArchivedMessage
+	pending       []PendingSubscription
+	held          []HeldMessage
+	replies       map[string][]time.Time
+	queue         []QueuedMessage
+}
+
+func newMemoryBackend(config Config, lists ...Definition) *memoryBackend {
+	return &memoryBackend{
+		config:        config,
+		lists:         lists,
+		subscriptions: map[string][]Subscription{},
+		lastDigests:   map[string]time.Time{},
+		archive:       map[string][]ArchivedMessage{},
+		replies:       map[string][]time.Time{},
+	}
+}
+
+func (b *memoryBackend) Config() Config {
+	return b.config
+}
+
+func (b *memoryBackend) Lists() ([]Definition, error) {
+	return append([]Definition{}, b.lists...), nil
+}
+
+func (b *memoryBackend) CreateList(d Definition) error {
+	b.lists = append(b.lists, d)
+	return nil
+}
+
+func (b *memoryBackend) ModifyList(address string, d Definition) error {
+	for i := range b.lists {
+		if b.lists[i].Address == address {
+			b.lists[i] = d
+			return nil
+		}
+	}
+	return fmt.Errorf("list %s does not exist", address)
+}
+
+func (b *memoryBackend) DeleteList(address string) error {
+	for i := range b.lists {
+		if b.lists[i].Address == address {
+			b.lists = append(b.lists[:i], b.lists[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("list %s does not exist", address)
+}
+
+func (b *memoryBackend) LookupList(address string) (*Definition, error) {
+	for _, d := range b.lists {
+		if d.Address == address {
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) ListSubscribe(l Definition, user string) error {
+	b.subscriptions[l.Address] = append(b.subscriptions[l.Address], Subscription{Address: user, Mode: ModeRegular})
+	return nil
+}
+
+func (b *memoryBackend) ListUnsubscribe(l Definition, user string) error {
+	subscriptions := b.subscriptions[l.Address]
+	for i, s := range subscriptions {
+		if s.Address == user {
+			b.subscriptions[l.Address] = append(subscriptions[:i], subscriptions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s is not subscribed to list %s", user, l.Address)
+}
+
+func (b *memoryBackend) ListSetMode(l Definition, user string, mode DeliveryMode) error {
+	for i, s := range b.subscriptions[l.Address] {
+		if s.Address == user {
+			b.subscriptions[l.Address][i].Mode = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s is not subscribed to list %s", user, l.Address)
+}
+
+func (b *memoryBackend) ListSetBounce(l Definition, user string, bounces uint16, lastBounce time.Time) error {
+	for i, s := range b.subscriptions[l.Address] {
+		if s.Address == user {
+			b.subscriptions[l.Address][i].Bounces = bounces
+			b.subscriptions[l.Address][i].LastBounce = lastBounce
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s is not subscribed to list %s", user, l.Address)
+}
+
+func (b *memoryBackend) ListSubscribers(l Definition) ([]Subscription, error) {
+	return append([]Subscription{}, b.subscriptions[l.Address]...), nil
+}
+
+func (b *memoryBackend) ListIsSubscribed(l Definition, user string) (*Subscription, error) {
+	for _, s := range b.subscriptions[l.Address] {
+		if s.Address == user {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) ListArchive(l Definition, msg *Message) error {
+	b.archive[l.Address] = append(b.archive[l.Address], ArchivedMessage{
+		ID:      msg.Address,
+		Sender:  msg.From,
+		Subject: msg.Subject,
+		Date:    time.Now(),
+		Message: []byte(msg.String()),
+	})
+	return nil
+}
+
+func (b *memoryBackend) ListArchived(l Definition, since time.Time, until time.Time) ([]ArchivedMessage, error) {
+	result := []ArchivedMessage{}
+	for _, m := range b.archive[l.Address] {
+		if m.Date.After(since) && !m.Date.After(until) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) ListLastDigest(l Definition) (time.Time, error) {
+	return b.lastDigests[l.Address], nil
+}
+
+func (b *memoryBackend) ListSetLastDigest(l Definition, t time.Time) error {
+	b.lastDigests[l.Address] = t
+	return nil
+}
+
+func (b *memoryBackend) ListAddPending(l Definition, user string, token string, expires time.Time) error {
+	b.pending = append(b.pending, PendingSubscription{List: l.Address, Address: user, Token: token, Expires: expires})
+	return nil
+}
+
+func (b *memoryBackend) ListPending(l Definition, user string) (*PendingSubscription, error) {
+	for _, p := range b.pending {
+		if p.List == l.Address && p.Address == user && p.Expires.After(time.Now()) {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) LookupPending(token string) (*PendingSubscription, error) {
+	for _, p := range b.pending {
+		if p.Token == token {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) DeletePending(token string) error {
+	for i, p := range b.pending {
+		if p.Token == token {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) ListHold(l Definition, h HeldMessage) error {
+	h.List = l.Address
+	b.held = append(b.held, h)
+	return nil
+}
+
+func (b *memoryBackend) LookupHeld(token string) (*HeldMessage, error) {
+	for _, h := range b.held {
+		if h.Token == token {
+			return &h, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *memoryBackend) DeleteHeld(token string) error {
+	for i, h := range b.held {
+		if h.Token == token {
+			b.held = append(b.held[:i], b.held[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) AddReply(address string, date time.Time) error {
+	b.replies[address] = append(b.replies[address], date)
+	return nil
+}
+
+func (b *memoryBackend) CountReplies(address string, since time.Time) (int, error) {
+	n := 0
+	for _, date := range b.replies[address] {
+		if date.After(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (b *memoryBackend) ListEnqueue(l Definition, q QueuedMessage) error {
+	q.List = l.Address
+	b.queue = append(b.queue, q)
+	return nil
+}
+
+func (b *memoryBackend) Queued() ([]QueuedMessage, error) {
+	result := []QueuedMessage{}
+	for _, q := range b.queue {
+		q.Deliveries = append([]QueuedDelivery{}, q.Deliveries...)
+		result = append(result, q)
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) UpdateQueued(id string, d QueuedDelivery) error {
+	for _, q := range b.queue {
+		for i := range q.Deliveries {
+			if q.ID == id && q.Deliveries[i].Recipient == d.Recipient {
+				q.Deliveries[i] = d
+			}
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) DeleteQueued(id string, recipient string) error {
+	queue := []QueuedMessage{}
+	for _, q := range b.queue {
+		if q.ID == id {
+			deliveries := []QueuedDelivery{}
+			for _, d := range q.Deliveries {
+				if d.Recipient != recipient {
+					deliveries = append(deliveries, d)
+				}
+			}
+			if len(deliveries) == 0 {
+				continue
+			}
+			q.Deliveries = deliveries
+		}
+		queue = append(queue, q)
+	}
+	b.queue = queue
+	return nil
+}
+
+func (b *memoryBackend) PurgeQueue(before time.Time) error {
+	queue := []QueuedMessage{}
+	for _, q := range b.queue {
+		if q.Created.Before(before) {
+			deliveries := []QueuedDelivery{}
+			for _, d := range q.Deliveries {
+				if d.Status != QueueFailed {
+					deliveries = append(deliveries, d)
+				}
+			}
+			q.Deliveries = deliveries
+		}
+		if len(q.Deliveries) > 0 {
+			queue = append(queue, q)
+		}
+	}
+	b.queue = queue
+	return nil
+}
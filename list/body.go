@@ -0,0 +1,109 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// plainText returns the decoded text of a message: its body if it is text/plain, or
+// the first text/plain part of a multipart body. It is empty if there is no such part.
+func (msg *Message) plainText() (string, error) {
+	return plainText(msg.ContentType, msg.Headers.Get("Content-Transfer-Encoding"), msg.Body)
+}
+
+func plainText(contentType string, encoding string, body []byte) (string, error) {
+	mediaType, params := "text/plain", map[string]string{}
+	if contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			// Quoted-printable parts are decoded by NextPart
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				return "", err
+			}
+			if part.FileName() != "" {
+				continue
+			}
+			text, err := plainText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), data)
+			if err == nil && text != "" {
+				return text, nil
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	decoded, ok, err := decodeTransferEncoding(encoding, body)
+	if err != nil || !ok {
+		return "", err
+	}
+	return decodeText(decoded, params["charset"])
+}
+
+// commandsFromBody reads commands from the text of a message, one per line, in the style
+// of majordomo. Empty lines and quoted lines are skipped. Reading stops at a line "end",
+// at a signature delimiter, or at the first line that does not start with a command.
+func commandsFromBody(text string) []string {
+	commands := []string{}
+	names := commandNames()
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := normalizeCommand(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, ">"):
+			continue
+		case strings.EqualFold(line, "end"), line == "--":
+			return commands
+		}
+
+		// Clients capitalize the first word of a line
+		name := strings.Fields(line)[0]
+		if !names[strings.ToLower(name)] {
+			return commands
+		}
+		commands = append(commands, strings.ToLower(name)+line[len(name):])
+	}
+
+	return commands
+}
+
+// decodeTransferEncoding decodes a body in a content transfer encoding. It returns
+// false if the encoding is unknown.
+func decodeTransferEncoding(encoding string, body []byte) ([]byte, bool, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return decoded, true, err
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+		return decoded, true, err
+	case "", "7bit", "8bit", "binary":
+		return append([]byte{}, body...), true, nil
+	}
+	return nil, false, nil
+}
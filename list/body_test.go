@@ -0,0 +1,66 @@
+package list
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandsFromBody(t *testing.T) {
+	tests := []struct {
+		text     string
+		commands []string
+	}{
+		{"", []string{}},
+		{"help\n", []string{"help"}},
+		{"Help\r\nList\r\n", []string{"help", "list"}},
+		{"\n\nsubscribe list@example.com\n\nunsubscribe other@example.com\n", []string{"subscribe list@example.com", "unsubscribe other@example.com"}},
+		{"list\nend\nhelp\n", []string{"list"}},
+		{"list\nEND\nhelp\n", []string{"list"}},
+		{"list\n-- \nhelp\n", []string{"list"}},
+		{"list\n--\nhelp\n", []string{"list"}},
+		{"list\nThanks!\nhelp\n", []string{"list"}},
+		{"Hello,\nhelp\n", []string{}},
+		{"> help\nlist\n>> confirm 0123\n", []string{"list"}},
+		{"list\n> Some quoted text\n> help\n", []string{"list"}},
+		{"confirm 0123\n", []string{"confirm 0123"}},
+		{"reject 0123 “spam”\n", []string{"reject 0123 \"spam\""}},
+		{"  list  \n", []string{"list"}},
+		{"update list@example.com --name Foo\n", []string{"update list@example.com --name Foo"}},
+	}
+
+	for _, test := range tests {
+		if commands := commandsFromBody(test.text); !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("commandsFromBody(%q) = %q, want %q", test.text, commands, test.commands)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		contentType string
+		encoding    string
+		body        string
+		text        string
+	}{
+		{"", "", "help\r\n", "help\r\n"},
+		{"text/plain; charset=utf-8", "", "help\r\n", "help\r\n"},
+		{"text/html", "", "<p>help</p>", ""},
+		{"text/plain; charset=iso-8859-1", "quoted-printable", "reject 0123 b=E8te\r\n", "reject 0123 bète\r\n"},
+		{"text/plain; charset=iso-8859-1", "", "reject 0123 \x93spam\x94\r\n", "reject 0123 “spam”\r\n"},
+		{"text/plain; charset=koi8-r", "", "help\r\n", "help\r\n"},
+		{"text/plain; charset=utf-8", "base64", "aGVscA0K", "help\r\n"},
+		{"multipart/alternative; boundary=b", "", "--b\r\nContent-Type: text/plain\r\n\r\nhelp\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>help</p>\r\n--b--\r\n", "help"},
+		{"multipart/mixed; boundary=b", "", "--b\r\nContent-Type: text/html\r\n\r\n<p>help</p>\r\n--b\r\nContent-Type: text/plain\r\n\r\nlist\r\n--b--\r\n", "list"},
+	}
+
+	for _, test := range tests {
+		text, err := plainText(test.contentType, test.encoding, []byte(test.body))
+		if err != nil {
+			t.Errorf("plainText(%q, %q) failed: %s", test.contentType, test.body, err.Error())
+			continue
+		}
+		if text != test.text {
+			t.Errorf("plainText(%q, %q) = %q, want %q", test.contentType, test.body, text, test.text)
+		}
+	}
+}
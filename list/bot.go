@@ -4,25 +4,55 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/mail"
 	"strings"
 	"time"
+
+	"github.com/kballard/go-shellquote"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 // A Config represents general configuration for a mailing list bot
 type Config struct {
-	CommandAddress string   `ini:"command_address"`
-	BouncesAddress string   `ini:"bounces_address"`
-	AdminAddresses []string `ini:"admin_addresses"`
-	SMTPHostname   string   `ini:"smtp_hostname"`
-	SMTPPort       uint64   `ini:"smtp_port"`
-	SMTPUsername   string   `ini:"smtp_username"`
-	SMTPPassword   string   `ini:"smtp_password"`
-	Debug          bool     `ini:"debug"`
+	CommandAddress        string   `ini:"command_address"`
+	BouncesAddress        string   `ini:"bounces_address"`
+	AdminAddresses        []string `ini:"admin_addresses"`
+	SMTPHostname          string   `ini:"smtp_hostname"`
+	SMTPPort              uint64   `ini:"smtp_port"`
+	SMTPUsername          string   `ini:"smtp_username"`
+	SMTPPassword          string   `ini:"smtp_password"`
+	DeliveryWorkers       int      `ini:"delivery_workers"`
+	DeliveryRate          float64  `ini:"delivery_rate"`
+	DomainRate            float64  `ini:"domain_rate"`
+	Secret                string   `ini:"secret"`
+	MaxHops               int      `ini:"max_hops"`
+	ReportLoops           bool     `ini:"report_loops"`
+	ReplyLimit            int      `ini:"reply_limit"`
+	UnsubscribeURL        string   `ini:"unsubscribe_url"`
+	ArchiveURL            string   `ini:"archive_url"`
+	HelpURL               string   `ini:"help_url"`
+	OwnerURL              string   `ini:"owner_url"`
+	DKIMDomain            string   `ini:"dkim_domain"`
+	DKIMSelector          string   `ini:"dkim_selector"`
+	DKIMKey               string   `ini:"dkim_key"`
+	DKIMHeaders           []string `ini:"dkim_headers"`
+	AuthservID            string   `ini:"authserv_id"`
+	AuthenticatedCommands bool     `ini:"authenticated_commands"`
+	Debug                 bool     `ini:"debug"`
 }
 
+// DefaultMaxHops is the number of lists a message can pass through if max_hops is not configured
+const DefaultMaxHops = 5
+
+// DefaultReplyLimit is the number of replies sent to an address per ReplyInterval if reply_limit is not configured
+const DefaultReplyLimit = 10
+
+// ReplyInterval is the period in which replies to an address are counted
+const ReplyInterval = time.Hour
+
 // A bot represents a mailing list bot
 type bot struct {
 	Config
@@ -31,6 +61,20 @@ type bot struct {
 	ModifyList func(*list, Definition) error
 	DeleteList func(*list) error
 	LookupList func(string) (*list, error)
+
+	LookupPending func(string) (*PendingSubscription, error)
+	DeletePending func(string) error
+	LookupHeld    func(string) (*HeldMessage, error)
+	DeleteHeld    func(string) error
+	AddReply      func(string, time.Time) error
+	CountReplies  func(string, time.Time) (int, error)
+	Queued        func() ([]QueuedMessage, error)
+	UpdateQueued  func(string, QueuedDelivery) error
+	DeleteQueued  func(string, string) error
+	PurgeQueue    func(time.Time) error
+
+	// Resolver is used for DNS lookups
+	Resolver Resolver
 }
 
 // Subscribe a given address to a listAddress
@@ -68,6 +112,110 @@ func (b *bot) Subscribe(address string, listAddress string, admin bool) (*list,
 	return list, nil
 }
 
+// RequestSubscription stores a pending subscription of a given address to a listAddress, and sends a confirmation request to that address
+func (b *bot) RequestSubscription(address string, listAddress string) (*list, error) {
+	if b.Secret == "" {
+		return nil, ErrNoSecret
+	}
+
+	list, err := b.LookupList(listAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if list == nil {
+		return nil, fmt.Errorf("Unable to subscribe to %s - it is not a valid mailing list", listAddress)
+	}
+
+	// Switch to id - in case we were passed address
+	listAddress = list.Address
+
+	subscription, err := list.IsSubscribed(address)
+	if err != nil {
+		return nil, err
+	}
+	if subscription != nil {
+		return list, fmt.Errorf("You are already subscribed to %s", listAddress)
+	}
+
+	if list.Locked {
+		return list, fmt.Errorf("List %s is locked, only admins can add subscribers", listAddress)
+	}
+
+	// Anyone can request a subscription for any address, so don't flood it with confirmation requests
+	pending, err := list.Pending(address)
+	if err != nil {
+		return list, err
+	}
+	if pending != nil {
+		return list, fmt.Errorf("A confirmation request for %s was already sent to %s, it expires on %s", listAddress, address, pending.Expires.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+
+	if b.rateLimited(canonicalAddress(address)) {
+		return list, fmt.Errorf("Too many messages were sent to %s recently, try again later", address)
+	}
+
+	expires := time.Now().Add(ConfirmationInterval)
+	token := signToken(b.Secret, expires, listAddress, address)
+
+	err = list.AddPending(address, token, expires)
+	if err != nil {
+		return list, fmt.Errorf("Subscription to %s failed with error: %s", listAddress, err.Error())
+	}
+
+	message := fmt.Sprintf("Someone, probably you, requested to subscribe %s to the mailing list %s <%s>.\n\n"+
+		"To confirm this request, reply to this message without changing the subject, "+
+		"or send a message to %s with the following subject:\n\n    confirm %s\n\n"+
+		"If you did not request this subscription, you can safely ignore this message. "+
+		"The request expires on %s.",
+		address, list.Name, listAddress, b.CommandAddress, token, expires.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+
+	err = b.notify(address, "confirm "+token, message)
+	if err != nil {
+		return list, fmt.Errorf("Sending the confirmation request for %s failed with error: %s", listAddress, err.Error())
+	}
+
+	err = b.AddReply(canonicalAddress(address), time.Now())
+	if err != nil {
+		log.Printf("REPLY_COUNT_FAILED To=%q Error=%s\n", address, err.Error())
+	}
+
+	log.Printf("SUBSCRIPTION_REQUESTED User=%q List=%q\n", address, listAddress)
+	return list, nil
+}
+
+// Confirm a pending subscription using the token that was sent to the subscriber
+func (b *bot) Confirm(token string) (*list, string, error) {
+	pending, err := b.LookupPending(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if pending == nil {
+		return nil, "", fmt.Errorf("Unable to confirm %s - it is not a valid confirmation token", token)
+	}
+
+	err = verifyToken(b.Secret, token, pending.List, pending.Address)
+	if err != nil {
+		if deleteErr := b.DeletePending(token); deleteErr != nil {
+			return nil, pending.Address, deleteErr
+		}
+		return nil, pending.Address, fmt.Errorf("Unable to confirm subscription to %s: %s", pending.List, err.Error())
+	}
+
+	list, err := b.Subscribe(pending.Address, pending.List, false)
+	if err != nil {
+		return list, pending.Address, err
+	}
+
+	err = b.DeletePending(token)
+	if err != nil {
+		return list, pending.Address, err
+	}
+
+	return list, pending.Address, nil
+}
+
 // Unsubscribe a given address from a listAddress
 func (b *bot) Unsubscribe(address string, listAddress string, admin bool) (*list, error) {
 	list, err := b.LookupList(listAddress)
@@ -107,6 +255,37 @@ func (b *bot) Unsubscribe(address string, listAddress string, admin bool) (*list
 	return list, nil
 }
 
+// SetMode sets the delivery mode of the subscription of a given address to a listAddress
+func (b *bot) SetMode(address string, listAddress string, mode DeliveryMode) (*list, error) {
+	list, err := b.LookupList(listAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if list == nil {
+		return nil, fmt.Errorf("Unable to change the subscription to %s - it is not a valid mailing list", listAddress)
+	}
+
+	// Switch to id - in case we were passed address
+	listAddress = list.Address
+
+	subscription, err := list.IsSubscribed(address)
+	if err != nil {
+		return nil, err
+	}
+	if subscription == nil {
+		return list, fmt.Errorf("You aren't subscribed to %s", listAddress)
+	}
+
+	err = list.SetMode(address, mode)
+	if err != nil {
+		return list, fmt.Errorf("Changing the subscription to %s failed with error: %s", listAddress, err.Error())
+	}
+
+	log.Printf("SUBSCRIPTION_MODE_SET User=%q List=%q Mode=%q\n", address, listAddress, mode)
+	return list, nil
+}
+
 // UnsubscribeAll unsubscribes a given address from all lists
 func (b *bot) UnsubscribeAll(address string, admin bool) ([]*list, error) {
 	lists, err := b.Lists()
@@ -149,38 +328,61 @@ func (b *bot) UnsubscribeAll(address string, admin bool) ([]*list, error) {
 
 // Handle a message from a io.Reader
 // Only returns error if no error message could be sent to the user
-func (b *bot) Handle(stream io.Reader) error {
+func (b *bot) Handle(stream io.Reader, envelope Envelope) error {
+	// The message is parsed in place, and must be handled before it is released
+	data, release, err := spool(stream)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	msg := &Message{}
-	err := msg.FromReader(stream)
+	err = msg.parse(data)
 	if err != nil {
 		return err
 	}
 	log.Printf("MESSAGE_RECEIVED Id=%q X-Original-To=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
 		msg.Address, msg.XOriginalTo, msg.From, msg.To, msg.Cc, msg.Bcc, msg.Subject)
+
+	msg.auth = authenticate(b.Resolver, data, envelope)
+	for _, result := range msg.auth.DKIM {
+		if result.Error != nil {
+			log.Printf("DKIM_FAILED Id=%q From=%q Domain=%q Error=%s\n", msg.Address, msg.From, result.Domain, result.Error.Error())
+		}
+	}
+	log.Printf("MESSAGE_AUTHENTICATED Id=%q From=%q Results=%q\n", msg.Address, msg.From, strings.Join(msg.auth.results(), "; "))
+
 	return b.HandleMessage(msg)
 }
 
 // HandleMessage handles a message
 func (b *bot) HandleMessage(msg *Message) error {
 	if b.isToCommandAddress(msg) {
+		// Auto-replies quote the subject, don't let them execute commands
+		if reason := isAutomated(msg); reason != "" {
+			log.Printf("COMMAND_IGNORED From=%q Command=%q Reason=%q\n", msg.From, msg.Subject, reason)
+			return nil
+		}
+
 		obj, err := mail.ParseAddress(msg.From)
 		if err != nil {
 			return err
 		}
-		obj.Address = strings.ToLower(obj.Address)
-
-		reply, err := b.executeCommand(obj.Address, msg.Subject)
-		if err != nil {
-			log.Printf("COMMAND_FAILED From=%q Command=%q Error=%s\n", msg.From, msg.Subject, err.Error())
+		obj.Address = canonicalAddress(obj.Address)
 
-			if reply == "" {
-				return b.reply(msg, fmt.Sprintf("Command failed: %s", err.Error()))
-			}
-		} else {
-			log.Printf("COMMAND_SUCCEEDED From=%q Command=%q Message=%s\n", msg.From, msg.Subject, strings.Replace(reply, "\n", " ", -1))
+		commands := b.commands(msg)
+		// Commands are read from the subject, which must be signed as well
+		authenticated := msg.auth.aligned(obj.Address, "subject")
+		if len(commands) == 1 {
+			return b.reply(msg, b.runCommand(msg, obj.Address, authenticated, commands[0]))
 		}
 
-		return b.reply(msg, reply)
+		// Combine the results of all commands in a single reply
+		var buf strings.Builder
+		for _, command := range commands {
+			fmt.Fprintf(&buf, ">>> %s\n%s\n\n", command, strings.TrimRight(b.runCommand(msg, obj.Address, authenticated, command), "\n"))
+		}
+		return b.reply(msg, strings.TrimRight(buf.String(), "\n"))
 	}
 
 	if br := b.isToBounceAddress(msg); br != nil {
@@ -207,41 +409,54 @@ func (b *bot) HandleMessage(msg *Message) error {
 		if err != nil {
 			return err
 		}
-		obj.Address = strings.ToLower(obj.Address)
+		obj.Address = canonicalAddress(obj.Address)
 
 		// Go through all lists - don't stop at the first error!
 		errors := map[string]error{}
 		for _, list := range lists {
-			if !list.CanPost(obj.Address) {
-				log.Printf("UNAUTHORISED_POST From=%q To=%q Cc=%q Bcc=%q", msg.From, msg.To, msg.Cc, msg.Bcc)
+			if b.isLoop(msg, list) {
+				log.Printf("LOOP_DETECTED listAddress=%q Id=%q From=%q Subject=%q Hops=%d\n", list.Address, msg.Address, msg.From, msg.Subject, len(msg.XLoop))
 
-				errors[list.Address] = fmt.Errorf("You are not an approved poster for this mailing list. Your message has not been delivered to %s", list.Address)
+				if b.ReportLoops {
+					b.reportLoop(list, msg)
+				}
 
 				continue
 			}
 
-			listMsg := msg.ResendAs(list, b.CommandAddress)
+			authorised := list.CanPost(obj.Address)
+			if authorised && list.Authenticated && !msg.auth.aligned(obj.Address) {
+				log.Printf("UNAUTHENTICATED_POST listAddress=%q Id=%q From=%q Results=%q\n", list.Address, msg.Address, msg.From, strings.Join(msg.auth.results(), "; "))
 
-			if err := list.Archive(listMsg); err != nil {
-				log.Printf("ARCHIVAL_FAILED listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
-					list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+				authorised = false
+			}
 
-				errors[list.Address] = err
+			if !authorised {
+				log.Printf("UNAUTHORISED_POST From=%q To=%q Cc=%q Bcc=%q", msg.From, msg.To, msg.Cc, msg.Bcc)
 
-				continue
-			}
+				switch list.Moderation {
+				case PolicyDiscard:
+					log.Printf("MESSAGE_DISCARDED listAddress=%q Id=%q From=%q Subject=%q\n", list.Address, msg.Address, msg.From, msg.Subject)
+				case PolicyHold:
+					if err := b.hold(list, obj.Address, msg); err != nil {
+						log.Printf("HOLD_FAILED listAddress=%q Id=%q From=%q Subject=%q Error=%s\n", list.Address, msg.Address, msg.From, msg.Subject, err.Error())
 
-			if err := list.Send(listMsg, b.BouncesAddress, b.SMTPHostname, b.SMTPPort, b.SMTPUsername, b.SMTPPassword, b.Debug); err != nil {
-				log.Printf("MESSAGE_FAILED listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
-					list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+						errors[list.Address] = err
 
-				errors[list.Address] = err
+						continue
+					}
+
+					errors[list.Address] = fmt.Errorf("You are not an approved poster for this mailing list. Your message to %s is held until a moderator approves it", list.Address)
+				default:
+					errors[list.Address] = fmt.Errorf("You are not an approved poster for this mailing list. Your message has not been delivered to %s", list.Address)
+				}
 
 				continue
 			}
 
-			log.Printf("MESSAGE_SENT listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
-				list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+			if err := b.post(list, msg); err != nil {
+				errors[list.Address] = err
+			}
 		}
 
 		// Check for errors
@@ -260,16 +475,147 @@ func (b *bot) HandleMessage(msg *Message) error {
 	return b.reply(msg, "No mailing lists addressed. Your message has not been delivered.")
 }
 
+// post sends a message to a list, after archiving it
+func (b *bot) post(list *list, msg *Message) error {
+	var arc *arcSet
+	if list.sendConfig(b.Config).DKIMKey != "" {
+		arc = b.prepareARC(list, msg)
+	}
+
+	listMsg := msg.ResendAs(list, b.Config)
+	listMsg.arc = arc
+
+	if err := b.mitigateDMARC(list, listMsg); err != nil {
+		log.Printf("DMARC_MITIGATION_FAILED listAddress=%q Id=%q From=%q Error=%s\n", list.Address, listMsg.Address, listMsg.From, err.Error())
+
+		return err
+	}
+
+	if err := list.Archive(listMsg); err != nil {
+		log.Printf("ARCHIVAL_FAILED listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
+			list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+
+		return err
+	}
+
+	queued, err := list.Send(listMsg, b.Config)
+	if err != nil {
+		log.Printf("MESSAGE_FAILED listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
+			list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+
+		return err
+	}
+
+	if queued > 0 {
+		log.Printf("MESSAGE_PARTIALLY_SENT listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q Queued=%d\n",
+			list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject, queued)
+
+		return nil
+	}
+
+	log.Printf("MESSAGE_SENT listAddress=%q Id=%q From=%q To=%q Cc=%q Bcc=%q Subject=%q\n",
+		list.Address, listMsg.Address, listMsg.From, listMsg.To, listMsg.Cc, listMsg.Bcc, listMsg.Subject)
+
+	return nil
+}
+
+// commands returns the commands in a message: the subject, followed by the commands in the body.
+// If the body contains commands, a subject that does not start with a command is ignored.
+func (b *bot) commands(msg *Message) []string {
+	text, err := msg.plainText()
+	if err != nil {
+		log.Printf("BODY_UNREADABLE Id=%q From=%q Error=%s\n", msg.Address, msg.From, err.Error())
+	}
+	commands := commandsFromBody(text)
+
+	subject := commandFromSubject(msg.Subject)
+	fields := strings.Fields(subject)
+	if len(commands) == 0 || len(fields) > 0 && commandNames()[strings.ToLower(fields[0])] {
+		commands = append([]string{subject}, commands...)
+	}
+	return commands
+}
+
+// runCommand executes a command from a message, and returns the text to reply
+func (b *bot) runCommand(msg *Message, fromAddress string, authenticated bool, command string) string {
+	reply, err := b.executeCommand(fromAddress, authenticated, command)
+	if err != nil {
+		log.Printf("COMMAND_FAILED From=%q Command=%q Error=%s\n", msg.From, command, err.Error())
+
+		if reply == "" {
+			return fmt.Sprintf("Command failed: %s", err.Error())
+		}
+	} else {
+		log.Printf("COMMAND_SUCCEEDED From=%q Command=%q Message=%s\n", msg.From, command, strings.Replace(reply, "\n", " ", -1))
+	}
+
+	return reply
+}
+
 // ExecuteCommand executes a command
-func (b *bot) executeCommand(fromAddress string, subject string) (string, error) {
-	admin := b.isAdmin(fromAddress)
+func (b *bot) executeCommand(fromAddress string, authenticated bool, subject string) (string, error) {
+	params, err := shellquote.Split(subject)
+	if err != nil {
+		return "", err
+	}
+
+	role := b.role(fromAddress, b.targetList(fromAddress, params))
+
+	// Don't trust a forged From header for privileged commands
+	if role > RoleUser && b.AuthenticatedCommands && !authenticated {
+		log.Printf("UNAUTHENTICATED_COMMAND From=%q Command=%q\n", fromAddress, subject)
+
+		role = RoleUser
+	}
 
 	var buf bytes.Buffer
-	cmd := NewCommand(admin, fromAddress, b, &buf)
-	_, err := cmd.ParseString(subject)
+	cmd := NewCommand(role, fromAddress, b, &buf)
+	_, err = cmd.Parse(params)
 	return buf.String(), err
 }
 
+// targetList finds the list a command applies to, if any
+func (b *bot) targetList(fromAddress string, params []string) *list {
+	// Parse the command as if the user were admin, without executing it
+	probe := NewCommand(RoleAdmin, fromAddress, b, ioutil.Discard)
+	ctx, _ := probe.app.ParseContext(params)
+	if ctx == nil {
+		return nil
+	}
+
+	for _, element := range ctx.Elements {
+		arg, ok := element.Clause.(*kingpin.ArgClause)
+		if !ok || element.Value == nil {
+			continue
+		}
+
+		switch arg.Model().Name {
+		case "list":
+			address := *element.Value
+			if assureAddress(&address) != nil {
+				return nil
+			}
+			list, err := b.LookupList(address)
+			if err != nil {
+				return nil
+			}
+			return list
+		case "token":
+			held, err := b.LookupHeld(*element.Value)
+			if err != nil || held == nil {
+				return nil
+			}
+			list, err := b.LookupList(held.List)
+			if err != nil {
+				return nil
+			}
+			return list
+		}
+	}
+
+	return nil
+}
+
 func (b *bot) handleBounce(br *BounceResponse) error {
 	list, err := b.LookupList(br.List)
 	if err != nil {
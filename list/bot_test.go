@@ -0,0 +1,99 @@
+package list
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kballard/go-shellquote"
+)
+
+func TestCommandPrivileges(t *testing.T) {
+	lists := []Definition{
+		{
+			Address:    "a@example.com",
+			Name:       "A",
+			Owners:     []string{"owner@example.com"},
+			Moderators: []string{"moderator@example.com"},
+		},
+		{
+			Address: "b@example.com",
+			Name:    "B",
+			Owners:  []string{"other@example.com"},
+		},
+	}
+	held := HeldMessage{
+		List:  "a@example.com",
+		Token: "0123456789abcdef",
+	}
+
+	tests := []struct {
+		from    string
+		command string
+		role    Role
+		ok      bool
+	}{
+		{"owner@example.com", "modify a@example.com --name Renamed", RoleOwner, true},
+		{"owner@example.com", "modify b@example.com --name Renamed", RoleUser, false},
+		{"owner@example.com", "update b@example.com --owner owner@example.com", RoleUser, false},
+		{"owner@example.com", "subscribe a@example.com --address new@example.com", RoleOwner, true},
+		{"owner@example.com", "subscribe b@example.com --address new@example.com", RoleUser, false},
+		{"owner@example.com", "unsubscribe b@example.com --address new@example.com", RoleUser, false},
+		{"owner@example.com", "set b@example.com mode nomail --address new@example.com", RoleUser, false},
+		{"moderator@example.com", "modify a@example.com --name Renamed", RoleModerator, false},
+		{"moderator@example.com", "subscribe a@example.com --address new@example.com", RoleModerator, false},
+		{"moderator@example.com", "modify b@example.com --name Renamed", RoleUser, false},
+		{"other@example.com", "reject " + held.Token, RoleUser, false},
+		{"other@example.com", "modify b@example.com --name Renamed", RoleOwner, true},
+		{"admin@example.com", "modify b@example.com --name Renamed", RoleAdmin, true},
+		{"owner@example.com", "create c@example.com", RoleUser, false},
+		{"owner@example.com", "delete a@example.com", RoleOwner, false},
+	}
+
+	for _, test := range tests {
+		backend := newMemoryBackend(Config{AdminAddresses: []string{"admin@example.com"}}, append([]Definition{}, lists...)...)
+		backend.held = []HeldMessage{held}
+		b := NewBot(backend)
+
+		params, err := shellquote.Split(test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		role := b.role(test.from, b.targetList(test.from, params))
+		if role != test.role {
+			t.Errorf("%s: %q got role %d, want %d", test.from, test.command, role, test.role)
+		}
+
+		_, err = b.executeCommand(test.from, true, test.command)
+		if test.ok && err != nil {
+			t.Errorf("%s: %q failed: %s", test.from, test.command, err.Error())
+		}
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: %q succeeded", test.from, test.command)
+			}
+			if !reflect.DeepEqual(backend.lists, lists) || len(backend.subscriptions) > 0 {
+				t.Errorf("%s: %q changed the lists", test.from, test.command)
+			}
+		}
+	}
+}
+
+func TestUnauthenticatedCommands(t *testing.T) {
+	backend := newMemoryBackend(Config{AuthenticatedCommands: true}, Definition{
+		Address: "a@example.com",
+		Name:    "A",
+		Owners:  []string{"owner@example.com"},
+	})
+	b := NewBot(backend)
+
+	_, err := b.executeCommand("owner@example.com", false, "modify a@example.com --name Renamed")
+	if err == nil {
+		t.Error("modify succeeded without authentication")
+	}
+
+	_, err = b.executeCommand("owner@example.com", true, "modify a@example.com --name Renamed")
+	if err != nil {
+		t.Errorf("modify failed with authentication: %s", err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package list
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+)
+
+// headerDecoder decodes encoded words (RFC 2047). Besides the charsets supported
+// by the mime package (utf-8, iso-8859-1 and us-ascii), it knows the Western
+// European charsets that mail clients commonly use.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// commandDecoder decodes encoded words like headerDecoder, but does not fail on unknown
+// charsets: only their ASCII characters are kept, which is all a command needs.
+var commandDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		reader, err := charsetReader(charset, input)
+		if err == nil {
+			return reader, nil
+		}
+		return decodeCharset(input, func(b byte) rune {
+			return '�'
+		})
+	},
+}
+
+// windows1252 maps the bytes 0x80-0x9f of windows-1252, which differ from iso-8859-1
+var windows1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+// iso885915 maps the bytes of iso-8859-15 that differ from iso-8859-1
+var iso885915 = map[byte]rune{
+	0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+}
+
+// charsetReader converts text in a charset the mime package does not know to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "windows-1252", "cp1252", "x-cp1252":
+		return decodeCharset(input, func(b byte) rune {
+			if b < 0xa0 {
+				return windows1252[b-0x80]
+			}
+			return rune(b)
+		})
+	case "iso-8859-15", "iso8859-15", "latin-9", "latin9":
+		return decodeCharset(input, func(b byte) rune {
+			if r, ok := iso885915[b]; ok {
+				return r
+			}
+			return rune(b)
+		})
+	}
+	return nil, fmt.Errorf("unsupported charset %s", charset)
+}
+
+// decodeCharset converts text in an ASCII compatible single byte charset to UTF-8,
+// using the given mapping for the bytes above 0x7f
+func decodeCharset(input io.Reader, high func(byte) rune) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf strings.Builder
+	for _, b := range data {
+		if b < 0x80 {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteRune(high(b))
+		}
+	}
+	return strings.NewReader(buf.String()), nil
+}
+
+// decodeText converts text in a charset to UTF-8. Unknown charsets are decoded
+// like commandDecoder does.
+func decodeText(data []byte, charset string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "us-ascii", "utf-8", "utf8":
+		return string(data), nil
+	case "iso-8859-1", "latin1":
+		// Mail clients label windows-1252 text as iso-8859-1, like browsers treat it as its superset
+		charset = "windows-1252"
+	}
+
+	reader, err := commandDecoder.CharsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	text, err := ioutil.ReadAll(reader)
+	return string(text), err
+}
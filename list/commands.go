@@ -3,9 +3,10 @@ package list
 import (
 	"fmt"
 	"io"
-	"net/mail"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/kballard/go-shellquote"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -14,7 +15,7 @@ import (
 // A Command represents a command parser
 type Command struct {
 	app                *kingpin.Application
-	admin              bool
+	role               Role
 	botFactory         botFactory
 	listCmd            *kingpin.CmdClause
 	listAll            *bool
@@ -28,17 +29,41 @@ type Command struct {
 	subscribeOptions   *commandSubscriptionOptions
 	unsubscribeCmd     *kingpin.CmdClause
 	unsubscribeOptions *commandSubscriptionOptions
+	setCmd             *kingpin.CmdClause
+	setOptions         *commandSetOptions
+	confirmCmd         *kingpin.CmdClause
+	confirmToken       *string
+	approveCmd         *kingpin.CmdClause
+	approveToken       *string
+	rejectCmd          *kingpin.CmdClause
+	rejectToken        *string
+	rejectReason       *[]string
 	w                  io.Writer
 	rc                 *int
 }
 
 type commandListOptions struct {
-	List        *string
-	Name        *string
-	Description *string
-	Flags       *[]string
-	Posters     *[]string
-	Bcc         *[]string
+	List          *string
+	Name          *string
+	Description   *string
+	Flags         *[]string
+	Moderation    *string
+	Mitigation    *string
+	ReplyTo       *string
+	ReplyToAddr   *string
+	DKIMDomain    *string
+	DKIMSelector  *string
+	DKIMKey       *string
+	ArchiveURL    *string
+	HelpURL       *string
+	OwnerURL      *string
+	SubjectPrefix *string
+	Footer        *string
+	NoFooter      *bool
+	Posters       *[]string
+	Bcc           *[]string
+	Owners        *[]string
+	Moderators    *[]string
 }
 
 type commandSubscriptionOptions struct {
@@ -46,17 +71,25 @@ type commandSubscriptionOptions struct {
 	Address *string
 }
 
+type commandSetOptions struct {
+	*commandSubscriptionOptions
+	Setting *string
+	Value   *string
+}
+
 // NewCommand returns a Command application object
-func NewCommand(admin bool, userAddress string, b *bot, w io.Writer) *Command {
+func NewCommand(role Role, userAddress string, b *bot, w io.Writer) *Command {
 	app := kingpin.New("tinylist", "Tiny list server")
 
-	c := AddCommand(app, admin, userAddress, func(*kingpin.ParseContext) *bot {
+	c := AddCommand(app, role, userAddress, func(*kingpin.ParseContext) *bot {
 		return b
 	})
 
 	if w != nil {
 		c.app.UsageWriter(w)
 		c.app.ErrorWriter(w)
+		// Commands from mail must not exit the bot, e.g. after printing help
+		c.app.Terminate(nil)
 		c.w = w
 	} else {
 		c.w = os.Stdout
@@ -65,11 +98,36 @@ func NewCommand(admin bool, userAddress string, b *bot, w io.Writer) *Command {
 	return c
 }
 
-// AddCommand adds bot commands to a given kingpin application
-func AddCommand(app *kingpin.Application, admin bool, userAddress string, botFactory botFactory) *Command {
+// commandNameSet holds the result of commandNames, which is computed once
+var commandNameSet struct {
+	sync.Once
+	names map[string]bool
+}
+
+// commandNames returns the names and aliases of all commands that can be sent to the bot.
+// The returned map must not be modified.
+func commandNames() map[string]bool {
+	commandNameSet.Do(func() {
+		c := NewCommand(RoleAdmin, "", nil, ioutil.Discard)
+
+		// Kingpin only adds the help command when it parses the first command
+		names := map[string]bool{"help": true}
+		for _, cmd := range c.app.Model().Commands {
+			names[cmd.Name] = true
+			for _, alias := range cmd.Aliases {
+				names[alias] = true
+			}
+		}
+		commandNameSet.names = names
+	})
+	return commandNameSet.names
+}
+
+// AddCommand adds bot commands to a given kingpin application, depending on the role of the user for the target list
+func AddCommand(app *kingpin.Application, role Role, userAddress string, botFactory botFactory) *Command {
 	c := &Command{
 		app:        app,
-		admin:      admin,
+		role:       role,
 		w:          os.Stdout,
 		botFactory: botFactory,
 	}
@@ -79,32 +137,68 @@ func AddCommand(app *kingpin.Application, admin bool, userAddress string, botFac
 	c.listCmd = app.Command("list", "List all lists and their subscribers").Action(c.list)
 	c.subscribeCmd = app.Command("subscribe", "Subscribe to a list").Action(c.subscribe)
 	c.unsubscribeCmd = app.Command("unsubscribe", "Unsubscribe from a list").Action(c.unsubscribe)
+	c.setCmd = app.Command("set", "Change a setting of a subscription, e.g. 'set <list> mode digest|nomail|regular'").Action(c.set)
+	c.confirmCmd = app.Command("confirm", "Confirm a subscription request").Action(c.confirm)
 
-	if admin {
+	if role >= RoleAdmin {
 		c.createCmd = app.Command("create", "Create a list").Action(c.create)
-		c.modifyCmd = app.Command("modify", "Update a list").Alias("update").Action(c.modify)
 		c.deleteCmd = app.Command("delete", "Delete a list").Action(c.delete)
 
 		c.listAll = c.listCmd.Flag("all", "Also list hidden lists").Short('a').Bool()
 		c.createOptions = addCommandListOptions(c.createCmd)
-		c.modifyOptions = addCommandListOptions(c.modifyCmd)
 		c.deleteList = c.deleteCmd.Arg("list", "The list address").Required().String()
 	}
 
-	c.subscribeOptions = addCommandSubscriptionOptions(c.subscribeCmd, userAddress, admin, true)
-	c.unsubscribeOptions = addCommandSubscriptionOptions(c.unsubscribeCmd, userAddress, admin, false)
+	if role >= RoleOwner {
+		c.modifyCmd = app.Command("modify", "Update a list").Alias("update").Action(c.modify)
+
+		c.modifyOptions = addCommandListOptions(c.modifyCmd)
+	}
+
+	if role >= RoleModerator {
+		c.approveCmd = app.Command("approve", "Approve a held message").Action(c.approve)
+		c.rejectCmd = app.Command("reject", "Reject a held message").Action(c.reject)
+
+		c.approveToken = c.approveCmd.Arg("token", "The token of the held message").Required().String()
+		c.rejectToken = c.rejectCmd.Arg("token", "The token of the held message").Required().String()
+		c.rejectReason = c.rejectCmd.Arg("reason", "The reason of the rejection, sent to the poster").Strings()
+	}
+
+	c.subscribeOptions = addCommandSubscriptionOptions(c.subscribeCmd, userAddress, role >= RoleOwner, true)
+	c.unsubscribeOptions = addCommandSubscriptionOptions(c.unsubscribeCmd, userAddress, role >= RoleOwner, false)
+	c.setOptions = &commandSetOptions{
+		commandSubscriptionOptions: addCommandSubscriptionOptions(c.setCmd, userAddress, role >= RoleOwner, true),
+		Setting:                    c.setCmd.Arg("setting", "The setting to change: mode").Required().Enum("mode"),
+		Value:                      c.setCmd.Arg("value", "The new value of the setting").Required().String(),
+	}
+	c.confirmToken = c.confirmCmd.Arg("token", "The token of the subscription request").Required().String()
 
 	return c
 }
 
 func addCommandListOptions(cmd *kingpin.CmdClause) *commandListOptions {
 	return &commandListOptions{
-		List:        cmd.Arg("list", "The address of the mailing list, must be a valid address pointing to the tinylist pipe").Required().String(),
-		Name:        cmd.Flag("name", "The name of the new mailing list, used as a title to refer to this mailing list").String(),
-		Description: cmd.Flag("description", "The description of the new mailing list").String(),
-		Flags:       cmd.Flag("flag", "Setting flags: locked, hidden, and/or subscribers_only").Short('f').Enums("locked", "hidden", "subscribers_only", ""),
-		Posters:     cmd.Flag("poster", "Limit posting on the list to these addresses").Strings(),
-		Bcc:         cmd.Flag("bcc", "Always put these addresses in blind copy, useful for archiving").Strings(),
+		List:          cmd.Arg("list", "The address of the mailing list, must be a valid address pointing to the tinylist pipe").Required().String(),
+		Name:          cmd.Flag("name", "The name of the new mailing list, used as a title to refer to this mailing list").String(),
+		Description:   cmd.Flag("description", "The description of the new mailing list").String(),
+		Flags:         cmd.Flag("flag", "Setting flags: locked, hidden, subscribers_only, authenticated and/or merge_reply_to").Short('f').Enums("locked", "hidden", "subscribers_only", "authenticated", "merge_reply_to", ""),
+		Moderation:    cmd.Flag("moderation", "What to do with posts of unauthorised posters: reject, hold or discard").Enum("reject", "hold", "discard"),
+		Mitigation:    cmd.Flag("dmarc-mitigation", "When to rewrite the From header of posts to pass DMARC checks: none, always or policy").Enum("none", "always", "policy"),
+		ReplyTo:       cmd.Flag("reply-to", "Where replies to posts go: poster, list or address").Enum("poster", "list", "address"),
+		ReplyToAddr:   cmd.Flag("reply-to-address", "Send replies to this address, with --reply-to=address").String(),
+		DKIMDomain:    cmd.Flag("dkim-domain", "Sign posts for this domain, defaults to the domain of the list").String(),
+		DKIMSelector:  cmd.Flag("dkim-selector", "Selector of the DKIM key of the list").String(),
+		DKIMKey:       cmd.Flag("dkim-key", "Path of the DKIM private key of the list, instead of the global one").String(),
+		ArchiveURL:    cmd.Flag("archive-url", "URL of the archive of the list, for the List-Archive header").String(),
+		HelpURL:       cmd.Flag("help-url", "URL with help about the list, for the List-Help header").String(),
+		OwnerURL:      cmd.Flag("owner-url", "URL to contact the owners of the list, for the List-Owner header").String(),
+		SubjectPrefix: cmd.Flag("subject-prefix", "Put this prefix in front of the subject of posts, e.g. [golang]").String(),
+		Footer:        cmd.Flag("footer", "Template of the footer appended to posts, with fields {{.List.Name}}, {{.List.Address}}, {{.List.Description}}, {{.Recipient}}, {{.CommandAddress}} and {{.UnsubscribeURL}}").String(),
+		NoFooter:      cmd.Flag("no-footer", "Don't append a footer to posts").Bool(),
+		Posters:       cmd.Flag("poster", "Limit posting on the list to these addresses").Strings(),
+		Bcc:           cmd.Flag("bcc", "Always put these addresses in blind copy, useful for archiving").Strings(),
+		Owners:        cmd.Flag("owner", "Allow these addresses to manage the list and its subscribers").Strings(),
+		Moderators:    cmd.Flag("moderator", "Allow these addresses to approve or reject held messages").Strings(),
 	}
 }
 
@@ -141,11 +235,15 @@ func (c *Command) parseAddresses(*kingpin.ParseContext) error {
 		addressVars = append(addressVars, c.createOptions.List)
 		addressesVars = append(addressesVars, c.createOptions.Posters)
 		addressesVars = append(addressesVars, c.createOptions.Bcc)
+		addressesVars = append(addressesVars, c.createOptions.Owners)
+		addressesVars = append(addressesVars, c.createOptions.Moderators)
 	}
 	if c.modifyOptions != nil {
 		addressVars = append(addressVars, c.modifyOptions.List)
 		addressesVars = append(addressesVars, c.modifyOptions.Posters)
 		addressesVars = append(addressesVars, c.modifyOptions.Bcc)
+		addressesVars = append(addressesVars, c.modifyOptions.Owners)
+		addressesVars = append(addressesVars, c.modifyOptions.Moderators)
 	}
 	if c.subscribeOptions != nil {
 		addressVars = append(addressVars, c.subscribeOptions.List)
@@ -155,6 +253,10 @@ func (c *Command) parseAddresses(*kingpin.ParseContext) error {
 		addressVars = append(addressVars, c.unsubscribeOptions.List)
 		addressVars = append(addressVars, c.unsubscribeOptions.Address)
 	}
+	if c.setOptions != nil {
+		addressVars = append(addressVars, c.setOptions.List)
+		addressVars = append(addressVars, c.setOptions.Address)
+	}
 
 	for _, address := range addressVars {
 		err := assureAddress(address)
@@ -177,11 +279,11 @@ func assureAddress(a *string) error {
 	if a == nil || *a == "" {
 		return nil
 	}
-	obj, err := mail.ParseAddress(*a)
+	address, err := parseAddress(*a)
 	if err != nil {
 		return err
 	}
-	*a = strings.ToLower(obj.Address)
+	*a = address
 	return nil
 }
 
@@ -194,11 +296,11 @@ func assureAddresses(a *[]string) error {
 		if v == "" {
 			r = append(r, "")
 		} else {
-			obj, err := mail.ParseAddress(v)
+			address, err := parseAddress(v)
 			if err != nil {
 				return err
 			}
-			r = append(r, strings.ToLower(obj.Address))
+			r = append(r, address)
 		}
 	}
 	*a = r
@@ -230,8 +332,8 @@ func (c *Command) list(ctx *kingpin.ParseContext) error {
 
 	fmt.Fprintf(c.w, "Available mailing lists:\n\n")
 	for _, list := range lists {
-		if !list.Hidden || *c.listAll {
-			if c.admin {
+		if !list.Hidden || (c.listAll != nil && *c.listAll) {
+			if c.role >= RoleAdmin {
 				fmt.Fprintf(c.w, "%s\n\n", list.String())
 			} else {
 				fmt.Fprintf(c.w, "%s <%s>: %s\n", list.Name, list.Address, list.Description)
@@ -255,9 +357,44 @@ func (c *Command) create(ctx *kingpin.ParseContext) error {
 	}
 
 	d := Definition{
-		Address:     *c.createOptions.List,
-		Name:        *c.createOptions.Name,
-		Description: *c.createOptions.Description,
+		Address:         *c.createOptions.List,
+		Name:            *c.createOptions.Name,
+		Description:     *c.createOptions.Description,
+		Moderation:      PolicyReject,
+		DMARCMitigation: MitigateNone,
+		ReplyTo:         ReplyToPoster,
+		ReplyToAddress:  *c.createOptions.ReplyToAddr,
+		DKIMDomain:      *c.createOptions.DKIMDomain,
+		DKIMSelector:    *c.createOptions.DKIMSelector,
+		DKIMKey:         *c.createOptions.DKIMKey,
+		ArchiveURL:      *c.createOptions.ArchiveURL,
+		HelpURL:         *c.createOptions.HelpURL,
+		OwnerURL:        *c.createOptions.OwnerURL,
+		SubjectPrefix:   *c.createOptions.SubjectPrefix,
+		Footer:          DefaultFooter,
+	}
+
+	if *c.createOptions.Footer != "" {
+		d.Footer = *c.createOptions.Footer
+	}
+	if *c.createOptions.NoFooter {
+		d.Footer = ""
+	}
+	if _, err := parseFooter(d.Footer); err != nil {
+		return fmt.Errorf("Invalid footer: %s", err.Error())
+	}
+
+	if *c.createOptions.Moderation != "" {
+		d.Moderation = ModerationPolicy(*c.createOptions.Moderation)
+	}
+	if *c.createOptions.Mitigation != "" {
+		d.DMARCMitigation = MitigationPolicy(*c.createOptions.Mitigation)
+	}
+	if *c.createOptions.ReplyTo != "" {
+		d.ReplyTo = ReplyToPolicy(*c.createOptions.ReplyTo)
+	}
+	if d.ReplyTo == ReplyToFixed && d.ReplyToAddress == "" {
+		return fmt.Errorf("A --reply-to-address is required with --reply-to=address")
 	}
 
 	for _, flag := range *c.createOptions.Flags {
@@ -268,21 +405,37 @@ func (c *Command) create(ctx *kingpin.ParseContext) error {
 			d.Locked = true
 		case "subscribers_only":
 			d.SubscribersOnly = true
+		case "authenticated":
+			d.Authenticated = true
+		case "merge_reply_to":
+			d.MergeReplyTo = true
 		}
 	}
 
 	d.Posters = []string{}
-	for _, address := range *c.modifyOptions.Posters {
+	for _, address := range *c.createOptions.Posters {
 		if address != "" {
 			d.Posters = append(d.Posters, address)
 		}
 	}
 	d.Bcc = []string{}
-	for _, address := range *c.modifyOptions.Bcc {
+	for _, address := range *c.createOptions.Bcc {
 		if address != "" {
 			d.Bcc = append(d.Bcc, address)
 		}
 	}
+	d.Owners = []string{}
+	for _, address := range *c.createOptions.Owners {
+		if address != "" {
+			d.Owners = append(d.Owners, address)
+		}
+	}
+	d.Moderators = []string{}
+	for _, address := range *c.createOptions.Moderators {
+		if address != "" {
+			d.Moderators = append(d.Moderators, address)
+		}
+	}
 
 	err = bot.CreateList(d)
 	if err != nil {
@@ -318,6 +471,77 @@ func (c *Command) modify(ctx *kingpin.ParseContext) error {
 	} else {
 		d.Description = list.Description
 	}
+	if *c.modifyOptions.SubjectPrefix != "" {
+		d.SubjectPrefix = *c.modifyOptions.SubjectPrefix
+	} else {
+		d.SubjectPrefix = list.SubjectPrefix
+	}
+	if *c.modifyOptions.NoFooter {
+		d.Footer = ""
+	} else if *c.modifyOptions.Footer != "" {
+		d.Footer = *c.modifyOptions.Footer
+	} else {
+		d.Footer = list.Footer
+	}
+	if _, err := parseFooter(d.Footer); err != nil {
+		return fmt.Errorf("Invalid footer: %s", err.Error())
+	}
+	if *c.modifyOptions.Moderation != "" {
+		d.Moderation = ModerationPolicy(*c.modifyOptions.Moderation)
+	} else {
+		d.Moderation = list.Moderation
+	}
+	if *c.modifyOptions.Mitigation != "" {
+		d.DMARCMitigation = MitigationPolicy(*c.modifyOptions.Mitigation)
+	} else {
+		d.DMARCMitigation = list.DMARCMitigation
+	}
+	if *c.modifyOptions.ReplyTo != "" {
+		d.ReplyTo = ReplyToPolicy(*c.modifyOptions.ReplyTo)
+	} else {
+		d.ReplyTo = list.ReplyTo
+	}
+	if *c.modifyOptions.ReplyToAddr != "" {
+		d.ReplyToAddress = *c.modifyOptions.ReplyToAddr
+	} else {
+		d.ReplyToAddress = list.ReplyToAddress
+	}
+	if d.ReplyTo == ReplyToFixed && d.ReplyToAddress == "" {
+		return fmt.Errorf("A --reply-to-address is required with --reply-to=address")
+	}
+	if *c.modifyOptions.ArchiveURL != "" {
+		d.ArchiveURL = *c.modifyOptions.ArchiveURL
+	} else {
+		d.ArchiveURL = list.ArchiveURL
+	}
+	if *c.modifyOptions.HelpURL != "" {
+		d.HelpURL = *c.modifyOptions.HelpURL
+	} else {
+		d.HelpURL = list.HelpURL
+	}
+	if *c.modifyOptions.OwnerURL != "" {
+		d.OwnerURL = *c.modifyOptions.OwnerURL
+	} else {
+		d.OwnerURL = list.OwnerURL
+	}
+	if c.role < RoleAdmin && (*c.modifyOptions.DKIMDomain != "" || *c.modifyOptions.DKIMSelector != "" || *c.modifyOptions.DKIMKey != "") {
+		return fmt.Errorf("Only administrators can change the DKIM settings of a list")
+	}
+	if *c.modifyOptions.DKIMDomain != "" {
+		d.DKIMDomain = *c.modifyOptions.DKIMDomain
+	} else {
+		d.DKIMDomain = list.DKIMDomain
+	}
+	if *c.modifyOptions.DKIMSelector != "" {
+		d.DKIMSelector = *c.modifyOptions.DKIMSelector
+	} else {
+		d.DKIMSelector = list.DKIMSelector
+	}
+	if *c.modifyOptions.DKIMKey != "" {
+		d.DKIMKey = *c.modifyOptions.DKIMKey
+	} else {
+		d.DKIMKey = list.DKIMKey
+	}
 	if len(*c.modifyOptions.Posters) > 0 {
 		d.Posters = []string{}
 		for _, address := range *c.modifyOptions.Posters {
@@ -338,6 +562,26 @@ func (c *Command) modify(ctx *kingpin.ParseContext) error {
 	} else {
 		d.Bcc = list.Bcc
 	}
+	if len(*c.modifyOptions.Owners) > 0 {
+		d.Owners = []string{}
+		for _, address := range *c.modifyOptions.Owners {
+			if address != "" {
+				d.Owners = append(d.Owners, address)
+			}
+		}
+	} else {
+		d.Owners = list.Owners
+	}
+	if len(*c.modifyOptions.Moderators) > 0 {
+		d.Moderators = []string{}
+		for _, address := range *c.modifyOptions.Moderators {
+			if address != "" {
+				d.Moderators = append(d.Moderators, address)
+			}
+		}
+	} else {
+		d.Moderators = list.Moderators
+	}
 
 	if len(*c.modifyOptions.Flags) > 0 {
 		for _, flag := range *c.modifyOptions.Flags {
@@ -348,12 +592,18 @@ func (c *Command) modify(ctx *kingpin.ParseContext) error {
 				d.Locked = true
 			case "subscribers_only":
 				d.SubscribersOnly = true
+			case "authenticated":
+				d.Authenticated = true
+			case "merge_reply_to":
+				d.MergeReplyTo = true
 			}
 		}
 	} else {
 		d.Hidden = list.Hidden
 		d.Locked = list.Locked
 		d.SubscribersOnly = list.SubscribersOnly
+		d.Authenticated = list.Authenticated
+		d.MergeReplyTo = list.MergeReplyTo
 	}
 
 	err = bot.ModifyList(list, d)
@@ -385,10 +635,42 @@ func (c *Command) delete(ctx *kingpin.ParseContext) error {
 	return nil
 }
 
+func (c *Command) approve(ctx *kingpin.ParseContext) error {
+	bot := c.botFactory(ctx)
+
+	list, held, err := bot.Approve(*c.approveToken)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.w, "The message from %s with subject %q has been sent to %s.\n", held.Sender, held.Subject, list.Address)
+	return nil
+}
+
+func (c *Command) reject(ctx *kingpin.ParseContext) error {
+	bot := c.botFactory(ctx)
+
+	list, held, err := bot.Reject(*c.rejectToken, strings.Join(*c.rejectReason, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.w, "The message from %s with subject %q to %s has been rejected.\n", held.Sender, held.Subject, list.Address)
+	return nil
+}
+
 func (c *Command) subscribe(ctx *kingpin.ParseContext) error {
 	bot := c.botFactory(ctx)
 
-	list, err := bot.Subscribe(*c.subscribeOptions.Address, *c.subscribeOptions.List, c.admin)
+	// Admins and owners can skip the confirmation of the subscription
+	if c.role < RoleOwner {
+		list, err := bot.RequestSubscription(*c.subscribeOptions.Address, *c.subscribeOptions.List)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.w, "A confirmation request has been sent to %s. Your subscription to %s will be active after confirmation.\n", *c.subscribeOptions.Address, list.Address)
+		return nil
+	}
+
+	list, err := bot.Subscribe(*c.subscribeOptions.Address, *c.subscribeOptions.List, c.role >= RoleOwner)
 	if err != nil {
 		return err
 	}
@@ -396,11 +678,43 @@ func (c *Command) subscribe(ctx *kingpin.ParseContext) error {
 	return nil
 }
 
+func (c *Command) set(ctx *kingpin.ParseContext) error {
+	bot := c.botFactory(ctx)
+
+	switch *c.setOptions.Setting {
+	case "mode":
+		mode := DeliveryMode(*c.setOptions.Value)
+		switch mode {
+		case ModeRegular, ModeDigest, ModeNoMail:
+		default:
+			return fmt.Errorf("Unknown delivery mode %s, use regular, digest or nomail", *c.setOptions.Value)
+		}
+
+		list, err := bot.SetMode(*c.setOptions.Address, *c.setOptions.List, mode)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.w, "Your subscription to %s is now in %s mode.\n", list.Address, mode)
+	}
+	return nil
+}
+
+func (c *Command) confirm(ctx *kingpin.ParseContext) error {
+	bot := c.botFactory(ctx)
+
+	list, address, err := bot.Confirm(*c.confirmToken)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.w, "%s is now subscribed to %s.\n", address, list.Address)
+	return nil
+}
+
 func (c *Command) unsubscribe(ctx *kingpin.ParseContext) error {
 	bot := c.botFactory(ctx)
 
 	if *c.unsubscribeOptions.List == "" {
-		lists, err := bot.UnsubscribeAll(*c.unsubscribeOptions.Address, c.admin)
+		lists, err := bot.UnsubscribeAll(*c.unsubscribeOptions.Address, c.role >= RoleAdmin)
 		if err != nil {
 			return err
 		}
@@ -409,7 +723,7 @@ func (c *Command) unsubscribe(ctx *kingpin.ParseContext) error {
 		}
 		return nil
 	}
-	list, err := bot.Unsubscribe(*c.unsubscribeOptions.Address, *c.unsubscribeOptions.List, c.admin)
+	list, err := bot.Unsubscribe(*c.unsubscribeOptions.Address, *c.unsubscribeOptions.List, c.role >= RoleOwner)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,115 @@
+package list
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDeliveryWorkers is the number of concurrent deliveries if delivery_workers is not configured
+const DefaultDeliveryWorkers = 4
+
+// A rateLimiter spaces events evenly at a maximum rate. A nil rateLimiter does not limit.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter for a rate in events per second, or nil if the rate is not positive
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the next event is allowed
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	now := time.Now()
+	next := l.next
+	if next.Before(now) {
+		next = now
+	}
+	l.next = next.Add(l.interval)
+	l.Unlock()
+
+	time.Sleep(next.Sub(now))
+}
+
+// deliveryLimits holds the global rate limit and the rate limits per destination domain
+type deliveryLimits struct {
+	sync.Mutex
+	global     *rateLimiter
+	domainRate float64
+	domains    map[string]*rateLimiter
+}
+
+func newDeliveryLimits(config Config) *deliveryLimits {
+	return &deliveryLimits{
+		global:     newRateLimiter(config.DeliveryRate),
+		domainRate: config.DomainRate,
+		domains:    map[string]*rateLimiter{},
+	}
+}
+
+// wait blocks until a delivery to a recipient is allowed
+func (d *deliveryLimits) wait(recipient string) {
+	domain := strings.ToLower(recipient[strings.LastIndex(recipient, "@")+1:])
+
+	d.Lock()
+	limiter, ok := d.domains[domain]
+	if !ok {
+		limiter = newRateLimiter(d.domainRate)
+		d.domains[domain] = limiter
+	}
+	d.Unlock()
+
+	limiter.wait()
+	d.global.wait()
+}
+
+// deliverAll calls deliver for every recipient, using a pool of workers that each
+// have their own SMTP session. It returns the error for each recipient, in order.
+func deliverAll(recipients []string, deliver func(*smtpSession, string) error, config Config) []error {
+	workers := config.DeliveryWorkers
+	if workers <= 0 {
+		workers = DefaultDeliveryWorkers
+	}
+	if workers > len(recipients) {
+		workers = len(recipients)
+	}
+
+	limits := newDeliveryLimits(config)
+	results := make([]error, len(recipients))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			session := config.smtpSession()
+			defer session.Close()
+
+			for i := range jobs {
+				limits.wait(recipients[i])
+				results[i] = deliver(session, recipients[i])
+			}
+		}()
+	}
+
+	for i := range recipients {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
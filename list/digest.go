@@ -0,0 +1,194 @@
+package list
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DigestOptions determine when a list is due for a digest
+type DigestOptions struct {
+	// Interval between two regular digests
+	Interval time.Duration
+	// MaxMessages triggers an early digest when this many messages are waiting, if not zero
+	MaxMessages int
+	// MaxSize triggers an early digest when the waiting messages exceed this size in bytes, if not zero
+	MaxSize int64
+}
+
+// SendDigests sends a digest for every list that is due, based on the archive since the last digest
+func (b *bot) SendDigests(options DigestOptions) error {
+	lists, err := b.Lists()
+	if err != nil {
+		return err
+	}
+
+	// Go through all lists - don't stop at the first error!
+	errors := map[string]error{}
+	for _, list := range lists {
+		n, err := b.sendDigest(list, options)
+		if err != nil {
+			log.Printf("DIGEST_FAILED List=%q Error=%s\n", list.Address, err.Error())
+
+			errors[list.Address] = err
+
+			continue
+		}
+
+		if n > 0 {
+			log.Printf("DIGEST_SENT List=%q Messages=%d\n", list.Address, n)
+		}
+	}
+
+	if len(errors) > 0 {
+		strs := []string{}
+		for address, err := range errors {
+			strs = append(strs, fmt.Sprintf("%s: %s", address, err.Error()))
+		}
+		return fmt.Errorf("%d digests failed: %s", len(errors), strings.Join(strs, ", "))
+	}
+
+	return nil
+}
+
+// sendDigest sends a digest for a single list if it is due, and returns the number of messages in it
+func (b *bot) sendDigest(list *list, options DigestOptions) (int, error) {
+	now := time.Now()
+
+	last, err := list.LastDigest()
+	if err != nil {
+		return 0, err
+	}
+	// Don't send the whole archive the first time
+	if last.IsZero() {
+		last = now.Add(-options.Interval)
+	}
+
+	messages, err := list.Archived(last, now)
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	var size int64
+	for _, m := range messages {
+		size += int64(len(m.Message))
+	}
+
+	due := now.Sub(last) >= options.Interval
+	if options.MaxMessages > 0 && len(messages) >= options.MaxMessages {
+		due = true
+	}
+	if options.MaxSize > 0 && size >= options.MaxSize {
+		due = true
+	}
+	if !due {
+		return 0, nil
+	}
+
+	digest, err := newDigest(list, messages, b.Config, now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent, err := list.SendDigest(digest, b.Config)
+	if !sent {
+		return 0, err
+	}
+
+	// Failed deliveries are queued or logged, sending the digest again would repeat it to everyone else
+	if setErr := list.SetLastDigest(now); setErr != nil {
+		return len(messages), setErr
+	}
+
+	return len(messages), err
+}
+
+// newDigest creates a MIME digest (RFC 2046) with a table of contents in the style of RFC 1153
+func newDigest(list *list, messages []ArchivedMessage, config Config, date time.Time) (*Message, error) {
+	commandAddress := config.CommandAddress
+
+	var (
+		body   bytes.Buffer
+		digest bytes.Buffer
+	)
+
+	outer := multipart.NewWriter(&body)
+	inner := multipart.NewWriter(&digest)
+
+	// Table of contents
+	toc := &bytes.Buffer{}
+	fmt.Fprintf(toc, "%s digest, %s\r\n\r\n", list.Name, date.Format("2 Jan 2006"))
+	if list.Description != "" {
+		fmt.Fprintf(toc, "%s\r\n\r\n", list.Description)
+	}
+	fmt.Fprintf(toc, "Today's Topics:\r\n\r\n")
+	for i, m := range messages {
+		subject, err := headerDecoder.DecodeHeader(m.Subject)
+		if err != nil {
+			subject = m.Subject
+		}
+		sender, err := headerDecoder.DecodeHeader(m.Sender)
+		if err != nil {
+			sender = m.Sender
+		}
+		fmt.Fprintf(toc, "  %d. %s (%s)\r\n", i+1, subject, sender)
+	}
+	fmt.Fprintf(toc, "\r\nTo change your delivery mode, email %s with 'set %s mode regular|digest|nomail' as the subject.\r\n", commandAddress, list.Address)
+
+	part, err := outer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Table of contents"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(toc.Bytes())
+
+	// Messages, the default content type within multipart/digest is message/rfc822
+	for _, m := range messages {
+		part, err := inner.CreatePart(textproto.MIMEHeader{})
+		if err != nil {
+			return nil, err
+		}
+		part.Write(m.Message)
+	}
+	err = inner.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	part, err = outer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/digest; boundary=%s", inner.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(digest.Bytes())
+
+	err = outer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{}
+	msg.Subject = fmt.Sprintf("%s digest, %s, %d messages", list.Name, date.Format("2 Jan 2006"), len(messages))
+	msg.From = (&mail.Address{Name: list.Name, Address: list.Address}).String()
+	msg.To = msg.From
+	msg.Date = date.Format("Mon, 2 Jan 2006 15:04:05 -0700")
+	msg.Address = newMessageID(config.CommandAddress)
+	msg.setListHeaders(list, config)
+	msg.MIMEVersion = "1.0"
+	msg.ContentType = fmt.Sprintf("multipart/mixed; boundary=%s", outer.Boundary())
+	msg.Headers = Header{}
+	msg.Body = body.Bytes()
+
+	return msg, nil
+}
@@ -0,0 +1,514 @@
+package list
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDKIMHeaders are the headers signed if dkim_headers is not configured
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "Sender",
+	"List-Id", "List-Unsubscribe", "List-Unsubscribe-Post", "List-Subscribe", "List-Post",
+	"List-Owner", "List-Archive", "List-Help",
+}
+
+// dkimKeys caches the keys read by readDKIMKey
+var dkimKeys sync.Map
+
+// readDKIMKey reads a PEM encoded RSA or Ed25519 private key
+func readDKIMKey(path string) (crypto.Signer, error) {
+	if key, ok := dkimKeys.Load(path); ok {
+		return key.(crypto.Signer), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T in %s", key, path)
+	}
+
+	dkimKeys.Store(path, key)
+	return key.(crypto.Signer), nil
+}
+
+// A dkimSigner signs messages with a DKIM key
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	headers  []string
+}
+
+// algorithm returns the signing algorithm of the key
+func (s *dkimSigner) algorithm() string {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// messageSignature returns a signature header field (RFC 6376) of the given name,
+// using relaxed canonicalization for both the header and the body. No timestamp
+// is added, so that the signature of a message is always the same.
+func (s *dkimSigner) messageSignature(name string, tags string, fields []string, bodyHash string) (string, error) {
+	hash := sha256.New()
+	signed := writeSignedHeaders(hash, fields, s.headers, "relaxed")
+
+	signature := fmt.Sprintf("%s: %s; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		name, tags, s.algorithm(), s.domain, s.selector, strings.Join(signed, ":"), bodyHash)
+
+	return s.sign(hash, signature)
+}
+
+// sign completes a signature header field, of which the hash contains the signed data
+func (s *dkimSigner) sign(hash hash.Hash, signature string) (string, error) {
+	hash.Write([]byte(relaxedHeader(signature)))
+
+	var (
+		b   []byte
+		err error
+	)
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		b, err = rsa.SignPKCS1v15(nil, k, crypto.SHA256, hash.Sum(nil))
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the hash of the data
+		b = ed25519.Sign(k, hash.Sum(nil))
+	default:
+		err = fmt.Errorf("Unsupported key type %T", s.key)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(b)
+	for len(encoded) > 72 {
+		signature += encoded[:72] + "\r\n\t"
+		encoded = encoded[72:]
+	}
+	return signature + encoded, nil
+}
+
+// writeSignedHeaders writes the canonicalized header fields to sign to a hash, and
+// returns their names. Multiple instances of a header field are used from the bottom up.
+func writeSignedHeaders(hash hash.Hash, fields []string, headers []string, canonicalization string) []string {
+	var (
+		signed []string
+		used   = map[int]bool{}
+	)
+	for _, name := range headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signed = append(signed, strings.ToLower(name))
+			hash.Write([]byte(canonicalHeader(fields[i], canonicalization) + "\r\n"))
+			break
+		}
+	}
+	return signed
+}
+
+// splitMessage splits a message in its header fields, including folded lines, and its body
+func splitMessage(data []byte) ([]string, []byte) {
+	var (
+		fields []string
+		rest   = data
+	)
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			i = len(rest) - 1
+		}
+		line := string(rest[:i+1])
+		rest = rest[i+1:]
+
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	for i, field := range fields {
+		fields[i] = strings.TrimRight(field, "\r\n")
+	}
+
+	return fields, rest
+}
+
+// fieldName returns the name of a header field
+func fieldName(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(field[:i])
+}
+
+var (
+	foldingSpace = regexp.MustCompile(`\r?\n`)
+	whiteSpace   = regexp.MustCompile(`[ \t]+`)
+)
+
+// canonicalHeader canonicalizes a header field using the "simple" or "relaxed" algorithm
+func canonicalHeader(field string, canonicalization string) string {
+	if canonicalization == "simple" {
+		return field
+	}
+	return relaxedHeader(field)
+}
+
+// relaxedHeader canonicalizes a header field using the "relaxed" algorithm
+func relaxedHeader(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return field
+	}
+
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := foldingSpace.ReplaceAllString(field[i+1:], "")
+	value = strings.TrimSpace(whiteSpace.ReplaceAllString(value, " "))
+
+	return name + ":" + value
+}
+
+// writeCanonicalBody writes a body canonicalized using the "simple" or "relaxed"
+// algorithm, line by line, and returns the length of the canonical body
+func writeCanonicalBody(w io.Writer, body []byte, canonicalization string) int64 {
+	n, _ := writeCanonicalLines(w, body, canonicalization, 0)
+	if n == 0 && canonicalization == "simple" {
+		w.Write([]byte("\r\n"))
+		n = 2
+	}
+	return n
+}
+
+// writeCanonicalLines writes the canonical lines of a part of a body, following
+// empty lines that were held back. It returns the length written, and the empty
+// lines it held back in turn: those at the end of the body are ignored, so they
+// are only written when more text follows.
+func writeCanonicalLines(w io.Writer, body []byte, canonicalization string, empty int) (int64, int) {
+	var (
+		n    int64
+		line []byte
+		crlf = []byte("\r\n")
+	)
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '\n')
+		if i < 0 {
+			line, body = body, nil
+		} else {
+			line, body = body[:i], body[i+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if canonicalization != "simple" {
+			line = bytes.TrimRight(relaxedLine(line), " ")
+		}
+
+		if len(line) == 0 {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			w.Write(crlf)
+			n += 2
+		}
+		w.Write(line)
+		w.Write(crlf)
+		n += int64(len(line)) + 2
+	}
+	return n, empty
+}
+
+// relaxedLine reduces all sequences of whitespace in a line to a single space
+func relaxedLine(line []byte) []byte {
+	if bytes.IndexByte(line, '\t') < 0 && !bytes.Contains(line, []byte("  ")) {
+		return line
+	}
+	return whiteSpace.ReplaceAll(line, []byte(" "))
+}
+
+// relaxedBodyHash returns the hash of a body in relaxed canonicalization
+func relaxedBodyHash(body []byte) string {
+	hash := sha256.New()
+	writeCanonicalBody(hash, body, "relaxed")
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// A bodyHash is the relaxed body hash of a body that is followed by a trailer.
+// The body is hashed once, the hash of each trailer continues from there.
+type bodyHash struct {
+	body  []byte // the hashed body, to recognize the copies that share it
+	state []byte // the hash state after the body
+	empty int    // the empty lines at the end of the body, hashed when the trailer has text
+}
+
+func newBodyHash(body []byte) *bodyHash {
+	hash := sha256.New()
+	_, empty := writeCanonicalLines(hash, body, "relaxed", 0)
+	state, _ := hash.(encoding.BinaryMarshaler).MarshalBinary()
+	return &bodyHash{body: body, state: state, empty: empty}
+}
+
+// of returns whether the hash is of the given body, without comparing its content
+func (h *bodyHash) of(body []byte) bool {
+	return len(h.body) == len(body) && (len(body) == 0 || &h.body[0] == &body[0])
+}
+
+// sum returns the hash of the body followed by a trailer. The trailer starts on a
+// new line, so a body followed by a trailer must end with a line break.
+func (h *bodyHash) sum(trailer []byte) string {
+	hash := sha256.New()
+	hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(h.state)
+	writeCanonicalLines(hash, trailer, "relaxed", h.empty)
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// A limitedWriter writes at most n bytes to w, and discards the rest
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.w.Write(p[:l.n])
+		l.n = 0
+		return len(p), nil
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// dkimPublicKey looks up the public key of a DKIM selector
+func dkimPublicKey(resolver Resolver, domain string, selector string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+
+	records, err := resolver.LookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		tags := parseTags(record)
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			continue
+		}
+
+		p := stripSpace(tags["p"])
+		if p == "" {
+			return nil, fmt.Errorf("The key %s is revoked", name)
+		}
+		data, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s: %s", name, err.Error())
+		}
+
+		switch tags["k"] {
+		case "", "rsa":
+			key, err := x509.ParsePKIXPublicKey(data)
+			if err != nil {
+				return x509.ParsePKCS1PublicKey(data)
+			}
+			if _, ok := key.(*rsa.PublicKey); !ok {
+				return nil, fmt.Errorf("The key %s is not an RSA key", name)
+			}
+			return key, nil
+		case "ed25519":
+			if len(data) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("Invalid key %s: wrong size", name)
+			}
+			return ed25519.PublicKey(data), nil
+		default:
+			return nil, fmt.Errorf("Unsupported key type %s for %s", tags["k"], name)
+		}
+	}
+
+	return nil, fmt.Errorf("No key found at %s", name)
+}
+
+// verifyHash verifies the signature of a hash with a public key
+func verifyHash(key crypto.PublicKey, algorithm string, hashed []byte, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm == "rsa-sha256" {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, signature)
+		}
+	case ed25519.PublicKey:
+		if algorithm == "ed25519-sha256" {
+			if !ed25519.Verify(k, hashed, signature) {
+				return fmt.Errorf("Invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported algorithm %s", algorithm)
+}
+
+// errPartialBody is returned for a valid signature of which the l= tag excludes part of the body
+var errPartialBody = errors.New("The signature does not cover the whole body")
+
+// verifyMessageSignature verifies a DKIM-Signature or ARC-Message-Signature header field, and returns its tags
+func verifyMessageSignature(resolver Resolver, field string, fields []string, body []byte) (map[string]string, error) {
+	tags := parseTags(field[strings.Index(field, ":")+1:])
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return tags, fmt.Errorf("Missing tag %s=", tag)
+		}
+	}
+
+	canonicalization := strings.SplitN(tags["c"]+"/", "/", 3)
+	headerCanonicalization, bodyCanonicalization := canonicalization[0], canonicalization[1]
+	if headerCanonicalization == "" {
+		headerCanonicalization = "simple"
+	}
+	if bodyCanonicalization == "" {
+		bodyCanonicalization = "simple"
+	}
+
+	bodyHash := sha256.New()
+	partial := false
+	if tags["l"] != "" {
+		length, err := strconv.ParseInt(tags["l"], 10, 64)
+		total := writeCanonicalBody(ioutil.Discard, body, bodyCanonicalization)
+		if err != nil || length > total {
+			return tags, fmt.Errorf("Invalid body length %s", tags["l"])
+		}
+		partial = length < total
+		writeCanonicalBody(&limitedWriter{w: bodyHash, n: length}, body, bodyCanonicalization)
+	} else {
+		writeCanonicalBody(bodyHash, body, bodyCanonicalization)
+	}
+	if base64.StdEncoding.EncodeToString(bodyHash.Sum(nil)) != stripSpace(tags["bh"]) {
+		return tags, fmt.Errorf("Body hash mismatch")
+	}
+
+	hash := sha256.New()
+	writeSignedHeaders(hash, fields, strings.Split(stripSpace(tags["h"]), ":"), headerCanonicalization)
+	hash.Write([]byte(canonicalHeader(withoutSignature(field), headerCanonicalization)))
+
+	signature, err := base64.StdEncoding.DecodeString(stripSpace(tags["b"]))
+	if err != nil {
+		return tags, err
+	}
+
+	key, err := dkimPublicKey(resolver, tags["d"], tags["s"])
+	if err != nil {
+		return tags, err
+	}
+
+	err = verifyHash(key, tags["a"], hash.Sum(nil), signature)
+	if err == nil && partial {
+		// Anything could have been appended to the signed part
+		err = errPartialBody
+	}
+	return tags, err
+}
+
+var signatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// withoutSignature empties the b= tag of a signature header field
+func withoutSignature(field string) string {
+	i := strings.Index(field, ":")
+	return field[:i+1] + signatureTag.ReplaceAllString(field[i+1:], "$1$2")
+}
+
+// stripSpace removes all white space, including folding, from a tag value
+func stripSpace(value string) string {
+	return strings.Join(strings.Fields(value), "")
+}
+
+// dkimSigner returns the signer for the configured DKIM key, or nil if no key is configured
+func (config Config) dkimSigner() (*dkimSigner, error) {
+	if config.DKIMKey == "" {
+		return nil, nil
+	}
+
+	if config.DKIMSelector == "" {
+		return nil, fmt.Errorf("No DKIM selector configured for key %s", config.DKIMKey)
+	}
+
+	key, err := readDKIMKey(config.DKIMKey)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := config.DKIMDomain
+	if domain == "" {
+		domain = config.CommandAddress[strings.LastIndex(config.CommandAddress, "@")+1:]
+	}
+
+	headers := config.DKIMHeaders
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+
+	return &dkimSigner{
+		domain:   domain,
+		selector: config.DKIMSelector,
+		key:      key,
+		headers:  headers,
+	}, nil
+}
+
+// sign adds a DKIM signature to the header of a message, if a key is configured
+func (config Config) sign(header []byte, bodyHash string) ([]byte, error) {
+	signer, err := config.dkimSigner()
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return header, nil
+	}
+
+	fields, _ := splitMessage(header)
+	signature, err := signer.messageSignature("DKIM-Signature", "v=1", fields, bodyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(signature+"\r\n"), header...), nil
+}
@@ -0,0 +1,139 @@
+package list
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// The signed message of RFC 8463, appendix A
+const rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=test; t=1528637909; h=from : to : subject :
+ date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3
+ DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz
+ dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+// rfc8463Seed is the Ed25519 private key of RFC 8463, appendix A
+const rfc8463Seed = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+
+var rfc8463Resolver = stubResolver{
+	txt: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		"test._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6" +
+			"Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9Pzo" +
+			"xZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"},
+	},
+}
+
+func crlf(s string) []byte {
+	return []byte(strings.Replace(s, "\n", "\r\n", -1))
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	fields, body := splitMessage(crlf(rfc8463Message))
+
+	algorithms := []string{"ed25519-sha256", "rsa-sha256"}
+	for i, algorithm := range algorithms {
+		tags, err := verifyMessageSignature(rfc8463Resolver, fields[i], fields, body)
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+		if tags["a"] != algorithm {
+			t.Errorf("%s: unexpected algorithm %s", algorithm, tags["a"])
+		}
+	}
+
+	// Any change to the signed header fields or the body breaks both signatures
+	tampered := append([]string{}, fields...)
+	tampered[4] = "Subject: Is dinner ready?!"
+	for i, algorithm := range algorithms {
+		if _, err := verifyMessageSignature(rfc8463Resolver, fields[i], tampered, body); err == nil {
+			t.Errorf("%s: tampered header verified", algorithm)
+		}
+		if _, err := verifyMessageSignature(rfc8463Resolver, fields[i], fields, append(body, "PS. Go team!\r\n"...)); err == nil {
+			t.Errorf("%s: tampered body verified", algorithm)
+		}
+	}
+
+	// Relaxed canonicalization ignores changes in white space
+	relaxed := append([]string{}, fields...)
+	relaxed[4] = "SUBJECT:  Is dinner\tready?  "
+	for i, algorithm := range algorithms {
+		if _, err := verifyMessageSignature(rfc8463Resolver, fields[i], relaxed, []byte(strings.Replace(string(body), "  ", " \t ", -1)+"\r\n\r\n")); err != nil {
+			t.Errorf("%s: relaxed: %v", algorithm, err)
+		}
+	}
+}
+
+func TestRelaxedBodyHashRFC8463(t *testing.T) {
+	_, body := splitMessage(crlf(rfc8463Message))
+	if hash := relaxedBodyHash(body); hash != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Errorf("relaxedBodyHash = %s", hash)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Seed)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	resolver := stubResolver{
+		txt: map[string][]string{
+			"brisbane._domainkey.football.example.com": rfc8463Resolver.txt["brisbane._domainkey.football.example.com"],
+			"rsa._domainkey.football.example.com":      {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic)},
+		},
+	}
+
+	signers := []*dkimSigner{
+		{domain: "football.example.com", selector: "brisbane", key: ed25519.NewKeyFromSeed(seed), headers: DefaultDKIMHeaders},
+		{domain: "football.example.com", selector: "rsa", key: rsaKey, headers: DefaultDKIMHeaders},
+	}
+
+	fields, body := splitMessage(crlf(rfc8463Message))
+	fields = fields[2:]
+
+	for _, signer := range signers {
+		signature, err := signer.messageSignature("DKIM-Signature", "v=1", fields, relaxedBodyHash(body))
+		if err != nil {
+			t.Fatalf("%s: %v", signer.algorithm(), err)
+		}
+
+		signed, _ := splitMessage([]byte(signature + "\r\n" + strings.Join(fields, "\r\n") + "\r\n\r\n"))
+		tags, err := verifyMessageSignature(resolver, signed[0], signed, body)
+		if err != nil {
+			t.Errorf("%s: %v", signer.algorithm(), err)
+		}
+		if tags["a"] != signer.algorithm() || tags["h"] != "from:subject:date:to:message-id" {
+			t.Errorf("%s: unexpected tags %v", signer.algorithm(), tags)
+		}
+	}
+}
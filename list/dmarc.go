@@ -0,0 +1,116 @@
+package list
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// dmarcPolicy returns the DMARC policy (RFC 7489) that applies to mail from a domain,
+// or an empty string if the domain doesn't publish one
+func dmarcPolicy(resolver Resolver, domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	// Fall back to the organizational domain, but not to the public suffix above it
+	names := []string{domain}
+	if org := organizationalDomain(domain); org != domain {
+		names = append(names, org)
+	}
+
+	for _, name := range names {
+		records, err := resolver.LookupTXT("_dmarc." + name)
+		if err != nil {
+			return "", err
+		}
+
+		for _, record := range records {
+			tags := parseTags(record)
+			if tags["v"] != "DMARC1" {
+				continue
+			}
+			if name != domain && tags["sp"] != "" {
+				return strings.ToLower(tags["sp"]), nil
+			}
+			return strings.ToLower(tags["p"]), nil
+		}
+	}
+
+	return "", nil
+}
+
+// organizationalDomain returns the domain one label below the public suffix
+// (RFC 7489, section 3.2), or the domain itself if it has none
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// parseTags parses a tag-value list such as "v=DMARC1; p=reject"
+func parseTags(record string) map[string]string {
+	tags := map[string]string{}
+	for _, field := range strings.Split(record, ";") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return tags
+}
+
+// mitigateDMARC rewrites the From header of a post if required by the DMARC mitigation policy of the list
+func (b *bot) mitigateDMARC(list *list, msg *Message) error {
+	switch list.DMARCMitigation {
+	case MitigateAlways:
+	case MitigatePolicy:
+		from, err := mail.ParseAddress(msg.From)
+		if err != nil {
+			return err
+		}
+
+		address, _ := asciiAddress(from.Address)
+		domain := address[strings.LastIndex(address, "@")+1:]
+		policy, err := dmarcPolicy(b.Resolver, domain)
+		if err != nil {
+			// Better safe than sorry, the post might be rejected by most recipients
+			log.Printf("DMARC_LOOKUP_FAILED listAddress=%q Domain=%q Error=%s\n", list.Address, domain, err.Error())
+		} else if policy != "reject" && policy != "quarantine" {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	err := msg.mungeFrom(list)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("FROM_REWRITTEN listAddress=%q Id=%q From=%q\n", list.Address, msg.Address, msg.Headers.Get("X-Original-From"))
+	return nil
+}
+
+// mungeFrom replaces the From header by the list address, adding the poster to Reply-To
+func (msg *Message) mungeFrom(list *list) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	name := from.Name
+	if name == "" {
+		name = from.Address[:strings.LastIndex(from.Address, "@")]
+	}
+
+	msg.Headers.Set("X-Original-From", msg.From)
+	msg.ReplyTo = mergeAddress(msg.ReplyTo, msg.From)
+
+	msg.From = (&mail.Address{Name: fmt.Sprintf("%s via %s", name, list.Name), Address: list.Address}).String()
+	return nil
+}
@@ -0,0 +1,101 @@
+package list
+
+import (
+	"testing"
+)
+
+func TestDMARCPolicy(t *testing.T) {
+	resolver := stubResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":        {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.example.com": {"v=DMARC1; p=none"},
+			"_dmarc.example.org":        {"v=spf1 -all", "v=DMARC1; p=Quarantine"},
+			"_dmarc.co.uk":              {"v=DMARC1; p=reject"},
+			"_dmarc.com":                {"v=DMARC1; p=reject"},
+		},
+		fail: map[string]bool{
+			"_dmarc.broken.example.net": true,
+		},
+	}
+
+	tests := []struct {
+		domain string
+		policy string
+		err    bool
+	}{
+		{"example.com", "reject", false},
+		{"EXAMPLE.COM.", "reject", false},
+		{"strict.example.com", "none", false},
+		{"mail.example.com", "quarantine", false},
+		{"a.b.mail.example.com", "quarantine", false},
+		{"example.org", "quarantine", false},
+		{"lists.example.org", "quarantine", false},
+		// The public suffix is not an organizational domain
+		{"example.co.uk", "", false},
+		{"mail.example.co.uk", "", false},
+		{"nodmarc.com", "", false},
+		{"broken.example.net", "", true},
+	}
+
+	for _, test := range tests {
+		policy, err := dmarcPolicy(resolver, test.domain)
+		if (err != nil) != test.err {
+			t.Errorf("dmarcPolicy(%q): unexpected error %v", test.domain, err)
+		}
+		if policy != test.policy {
+			t.Errorf("dmarcPolicy(%q) = %q, want %q", test.domain, policy, test.policy)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":         "example.com",
+		"mail.example.com":    "example.com",
+		"a.b.example.co.uk":   "example.co.uk",
+		"lists.example.ac.be": "example.ac.be",
+		"user.github.io":      "user.github.io",
+		"com":                 "com",
+	}
+
+	for domain, want := range tests {
+		if org := organizationalDomain(domain); org != want {
+			t.Errorf("organizationalDomain(%q) = %q, want %q", domain, org, want)
+		}
+	}
+}
+
+func TestMungeFrom(t *testing.T) {
+	l := &list{Definition: Definition{Address: "foo@example.com", Name: "Foo"}}
+
+	tests := []struct {
+		from    string
+		replyTo string
+		want    string
+	}{
+		{"Bob <bob@example.org>", "", "Bob <bob@example.org>"},
+		{"bob@example.org", "", "bob@example.org"},
+		{"Bob <bob@example.org>", "Carol <carol@example.net>", "Carol <carol@example.net>, Bob <bob@example.org>"},
+		{"Bob <bob@example.org>", "BOB@example.org", "BOB@example.org"},
+	}
+
+	for _, test := range tests {
+		msg := &Message{From: test.from, ReplyTo: test.replyTo}
+		if err := msg.mungeFrom(l); err != nil {
+			t.Fatalf("mungeFrom(%q): %v", test.from, err)
+		}
+
+		if msg.ReplyTo != test.want {
+			t.Errorf("mungeFrom(%q, %q): Reply-To = %q, want %q", test.from, test.replyTo, msg.ReplyTo, test.want)
+		}
+		if got := msg.Headers.Get("X-Original-From"); got != test.from {
+			t.Errorf("mungeFrom(%q): X-Original-From = %q", test.from, got)
+		}
+	}
+
+	msg := &Message{From: "Bob <bob@example.org>"}
+	msg.mungeFrom(l)
+	if msg.From != "\"Bob via Foo\" <foo@example.com>" {
+		t.Errorf("mungeFrom: From = %q", msg.From)
+	}
+}
@@ -0,0 +1,145 @@
+package list
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"text/template"
+)
+
+// DefaultFooter is the footer template of new lists
+const DefaultFooter = `_______________________________________________
+{{.List.Name}}{{if .List.Description}} - {{.List.Description}}{{end}}
+To unsubscribe, email {{.CommandAddress}} with 'unsubscribe {{.List.Address}}' as the subject.{{if .UnsubscribeURL}}
+Or unsubscribe {{.Recipient}} with a single click: {{.UnsubscribeURL}}{{end}}`
+
+// FooterData is passed to the footer template of a list
+type FooterData struct {
+	List           Definition
+	Recipient      string
+	CommandAddress string
+	UnsubscribeURL string
+}
+
+// parseFooter parses a footer template
+func parseFooter(footer string) (*template.Template, error) {
+	return template.New("footer").Parse(footer)
+}
+
+// renderFooter renders a parsed footer template for a recipient
+func renderFooter(tmpl *template.Template, data FooterData) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	// Use CRLF line endings, as in the rest of the message
+	footer := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	return strings.Replace(footer, "\n", "\r\n", -1), nil
+}
+
+// footerPartHeader is the header of the MIME part with the footer. The footer is
+// always quoted-printable, so the part header is the same for every recipient.
+var footerPartHeader = textproto.MIMEHeader{
+	"Content-Type":              {"text/plain; charset=utf-8"},
+	"Content-Disposition":       {"inline"},
+	"Content-Transfer-Encoding": {"quoted-printable"},
+}
+
+// withFooterPart returns a copy of a message of which the body ends in the header of
+// a footer part, and what follows the footer. The copies for the recipients share
+// that body, and only differ in their footer (see footerTrailer). A multipart/mixed
+// body gets the footer as its last part, any other body is wrapped in one, so that
+// attachments and signed parts are left untouched.
+func (msg *Message) withFooterPart() (*Message, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.ContentType)
+	if err == nil && mediaType == "multipart/mixed" {
+		if send, end, ok := msg.insertFooterPart(params["boundary"]); ok {
+			return send, end, nil
+		}
+	}
+	return msg.wrapFooterPart()
+}
+
+// insertFooterPart starts a footer part before the closing delimiter of a
+// multipart/mixed body. It returns false if the delimiter could not be found.
+func (msg *Message) insertFooterPart(boundary string) (*Message, []byte, bool) {
+	if boundary == "" {
+		return nil, nil, false
+	}
+
+	i := bytes.LastIndex(msg.Body, []byte("--"+boundary+"--"))
+	if i < 0 || (i > 0 && msg.Body[i-1] != '\n') {
+		return nil, nil, false
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(i + 256)
+	buf.Write(msg.Body[:i])
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	for _, key := range []string{"Content-Type", "Content-Disposition", "Content-Transfer-Encoding"} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, footerPartHeader.Get(key))
+	}
+	buf.WriteString("\r\n")
+
+	send := *msg
+	send.Body = buf.Bytes()
+	return &send, append([]byte("\r\n"), msg.Body[i:]...), true
+}
+
+// wrapFooterPart puts the original body in a multipart/mixed body, followed by the
+// header of the footer part
+func (msg *Message) wrapFooterPart() (*Message, []byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(msg.Body) + 512)
+	w := multipart.NewWriter(&buf)
+
+	// The content headers describe the original body, move them to its part
+	header := textproto.MIMEHeader{}
+	if msg.ContentType != "" {
+		header.Set("Content-Type", msg.ContentType)
+	}
+	headers := Header{}
+	for _, field := range msg.Headers {
+		if strings.HasPrefix(field.Key, "Content-") {
+			header.Add(field.Key, field.Value)
+		} else {
+			headers = append(headers, field)
+		}
+	}
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	part.Write(msg.Body)
+
+	_, err = w.CreatePart(footerPartHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	send := *msg
+	send.Headers = headers
+	send.MIMEVersion = "1.0"
+	send.ContentType = mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})
+	send.Body = buf.Bytes()
+	return &send, []byte("\r\n--" + w.Boundary() + "--\r\n"), nil
+}
+
+// footerTrailer returns the footer of a copy in the footer part started by
+// withFooterPart, followed by the end of the body
+func footerTrailer(footer string, end []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(footer) + len(end) + 64)
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(footer))
+	w.Close()
+	buf.Write(end)
+	return buf.Bytes()
+}
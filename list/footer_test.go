@@ -0,0 +1,60 @@
+package list
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestFooterPart(t *testing.T) {
+	l := &list{Definition: Definition{Address: "foo@example.com", Name: "Foo", Footer: "Foo – {{.Recipient}}"}}
+
+	tests := []struct {
+		contentType string
+		body        string
+		parts       []string
+	}{
+		{"", "Hello\r\n", []string{"Hello\r\n"}},
+		{"text/plain; charset=utf-8", "Hello", []string{"Hello"}},
+		{"multipart/mixed; boundary=b", "--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n--b\r\nContent-Type: image/png\r\n\r\nPNG\r\n--b--\r\nEpilogue\r\n", []string{"Hello", "PNG"}},
+		{"multipart/alternative; boundary=b", "--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>Hello</p>\r\n--b--\r\n", nil},
+	}
+
+	for _, test := range tests {
+		post := &Message{From: "bob@example.org", Subject: "Test", ContentType: test.contentType, Body: []byte(test.body)}
+		personalize := l.personalizer(post, Config{})
+
+		for _, recipient := range []string{"one@example.net", "two@example.net"} {
+			msg := &Message{}
+			if err := msg.parse([]byte(personalize(recipient).String())); err != nil {
+				t.Fatal(err)
+			}
+
+			mediaType, params, err := mime.ParseMediaType(msg.ContentType)
+			if err != nil || mediaType != "multipart/mixed" {
+				t.Fatalf("%q: got content type %q", test.contentType, msg.ContentType)
+			}
+			reader := multipart.NewReader(bytes.NewReader(msg.Body), params["boundary"])
+			parts := []string{}
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				data, _ := ioutil.ReadAll(part)
+				parts = append(parts, string(data))
+			}
+
+			if len(parts) == 0 || parts[len(parts)-1] != "Foo – "+recipient {
+				t.Errorf("%q: the last part is not the footer of %s: %q", test.contentType, recipient, parts)
+				continue
+			}
+			if test.parts != nil && strings.Join(parts[:len(parts)-1], "|") != strings.Join(test.parts, "|") {
+				t.Errorf("%q: got parts %q, want %q", test.contentType, parts[:len(parts)-1], test.parts)
+			}
+		}
+	}
+}
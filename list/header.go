@@ -0,0 +1,243 @@
+package list
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// MaxLineLength is the line length that generated header fields are folded to (RFC 5322 section 2.1.1)
+const MaxLineLength = 78
+
+// A HeaderField is a single header field of a message
+type HeaderField struct {
+	// Key is the canonical name of the field
+	Key string
+	// Value is the unfolded value of the field
+	Value string
+	// Raw is the field as it was received, including its name and folding.
+	// It is empty for fields that are generated.
+	Raw string
+}
+
+// A Header holds header fields in their original order. The methods that
+// modify a Header never change the underlying array, so copies of a
+// message can share it.
+type Header []HeaderField
+
+// parseHeader parses the raw header fields of a message
+func parseHeader(fields []string) (Header, error) {
+	header := Header{}
+	for _, field := range fields {
+		i := strings.Index(field, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed header line: %q", field)
+		}
+
+		raw := strings.Replace(strings.Replace(field, "\r\n", "\n", -1), "\n", "\r\n", -1)
+		header = append(header, HeaderField{
+			Key:   textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(field[:i])),
+			Value: unfold(field[i+1:]),
+			Raw:   raw,
+		})
+	}
+	return header, nil
+}
+
+// unfold removes the folding of a header value
+func unfold(value string) string {
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	value = strings.Replace(value, "\n ", " ", -1)
+	value = strings.Replace(value, "\n\t", " ", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	return strings.TrimSpace(value)
+}
+
+// Get returns the first value of a key
+func (h Header) Get(key string) string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	for _, field := range h {
+		if field.Key == key {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns all values of a key
+func (h Header) Values(key string) []string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	values := []string{}
+	for _, field := range h {
+		if field.Key == key {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Add adds a field at the end of the header
+func (h *Header) Add(key string, value string) {
+	header := append(Header{}, *h...)
+	*h = append(header, HeaderField{Key: textproto.CanonicalMIMEHeaderKey(key), Value: value})
+}
+
+// Set replaces all fields of a key by a single field at the end of the header
+func (h *Header) Set(key string, value string) {
+	h.Del(key)
+	*h = append(*h, HeaderField{Key: textproto.CanonicalMIMEHeaderKey(key), Value: value})
+}
+
+// Del removes all fields of a key
+func (h *Header) Del(key string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	header := Header{}
+	for _, field := range *h {
+		if field.Key != key {
+			header = append(header, field)
+		}
+	}
+	*h = header
+}
+
+// String returns the fields in their original form, or folded and encoded if they are generated
+func (h Header) String() string {
+	var buf strings.Builder
+	for _, field := range h {
+		if field.Raw != "" {
+			buf.WriteString(field.Raw + "\r\n")
+			continue
+		}
+		buf.WriteString(formatHeader(field.Key, field.Value))
+	}
+	return buf.String()
+}
+
+// formatHeader formats a generated header field: the value is unfolded,
+// non-ASCII text is encoded (RFC 2047), and the field is folded
+func formatHeader(key string, value string) string {
+	// Unfold the value, any other line break would end the field
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	value = strings.Replace(value, "\n ", " ", -1)
+	value = strings.Replace(value, "\n\t", "\t", -1)
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, value))
+
+	if !isASCII(value) {
+		value = encodeHeader(key, value)
+	}
+
+	return fold(key+": "+value) + "\r\n"
+}
+
+// encodeHeader encodes the non-ASCII text in a header value. In address fields,
+// only display names can be encoded.
+func encodeHeader(key string, value string) string {
+	switch textproto.CanonicalMIMEHeaderKey(key) {
+	case "From", "To", "Cc", "Bcc", "Reply-To", "Sender", "X-Original-From":
+		addresses, err := mail.ParseAddressList(value)
+		if err != nil {
+			return value
+		}
+		formatted := []string{}
+		for _, address := range addresses {
+			formatted = append(formatted, address.String())
+		}
+		return strings.Join(formatted, ", ")
+	case "Message-Id", "In-Reply-To", "References", "Date", "MIME-Version", "Content-Type":
+		// Structured fields that cannot contain encoded words
+		return value
+	case "List-Id", "X-Mailing-List", "X-Loop":
+		// A phrase followed by an identifier between angle brackets
+		i := strings.LastIndex(value, " <")
+		if i < 0 {
+			return value
+		}
+		return encodeWords(value[:i]) + value[i:]
+	default:
+		return encodeWords(value)
+	}
+}
+
+// encodeWords encodes the runs of words in unstructured text that contain
+// non-ASCII characters, so the ASCII words stay readable
+func encodeWords(value string) string {
+	words := strings.Split(value, " ")
+	result := []string{}
+	for i := 0; i < len(words); i++ {
+		if isASCII(words[i]) {
+			result = append(result, words[i])
+			continue
+		}
+		j := i + 1
+		for j < len(words) && !isASCII(words[j]) {
+			j++
+		}
+		result = append(result, mime.QEncoding.Encode("utf-8", strings.Join(words[i:j], " ")))
+		i = j - 1
+	}
+	return strings.Join(result, " ")
+}
+
+// phrase formats a display name as a phrase (RFC 5322), quoting or encoding it if needed
+func phrase(name string) string {
+	if !isASCII(name) {
+		return mime.QEncoding.Encode("utf-8", name)
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~ ", r) && !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return quoteString(name)
+		}
+	}
+	return name
+}
+
+// quoteString formats ASCII text as a quoted-string (RFC 5322 section 3.2.4)
+func quoteString(text string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, r := range text {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < ' ' && r != '\t' || r == 0x7f:
+			// Control characters cannot be quoted
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// fold folds a header field at whitespace, so lines do not exceed MaxLineLength
+// where possible. Unfolding the result gives back the original field. Lines are
+// only broken before a word, so no line consists of whitespace only (RFC 5322 section 3.2.2).
+func fold(field string) string {
+	if len(field) <= MaxLineLength {
+		return field
+	}
+
+	var buf strings.Builder
+	line := 0
+	for i, word := range strings.Split(field, " ") {
+		if i > 0 {
+			if line+1+len(word) > MaxLineLength && line > 0 && word != "" {
+				buf.WriteString("\r\n")
+				line = 0
+			}
+			buf.WriteString(" ")
+			line++
+		}
+		buf.WriteString(word)
+		line += len(word)
+	}
+	return buf.String()
+}
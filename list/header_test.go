@@ -0,0 +1,95 @@
+package list
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestFormatHeader(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{"Subject", "Hello  world", "Subject: Hello  world\r\n"},
+		{"Subject", "Hello\tworld", "Subject: Hello\tworld\r\n"},
+		{"Subject", "Hello\r\n world", "Subject: Hello world\r\n"},
+		{"Subject", "Hello\r\n\tworld", "Subject: Hello\tworld\r\n"},
+		{"Subject", " Hello world ", "Subject: Hello world\r\n"},
+		// A line break that is not folding must not start a new field
+		{"Subject", "Hello\r\nBcc: eve@example.com", "Subject: Hello Bcc: eve@example.com\r\n"},
+		{"Subject", "Hello\nBcc: eve@example.com", "Subject: Hello Bcc: eve@example.com\r\n"},
+		{"Subject", "Café ouvert", "Subject: =?utf-8?q?Caf=C3=A9?= ouvert\r\n"},
+		{"Subject", strings.Repeat("word ", 20), "Subject: " + strings.TrimSpace(strings.Repeat("word ", 14)) + "\r\n " + strings.TrimSpace(strings.Repeat("word ", 6)) + "\r\n"},
+	}
+
+	for _, test := range tests {
+		if got := formatHeader(test.key, test.value); got != test.want {
+			t.Errorf("formatHeader(%q, %q) = %q, want %q", test.key, test.value, got, test.want)
+		}
+	}
+}
+
+func TestPhrase(t *testing.T) {
+	tests := map[string]string{
+		"Foo":             "Foo",
+		"Foo Bar":         "Foo Bar",
+		"Foo & Bar's":     "Foo & Bar's",
+		"Foo, Bar":        `"Foo, Bar"`,
+		"Foo (Bar)":       `"Foo (Bar)"`,
+		`Foo "Bar"`:       `"Foo \"Bar\""`,
+		`Foo\Bar`:         `"Foo\\Bar"`,
+		"Foo:\tBar":       "\"Foo:\tBar\"",
+		"Foo\x00.Bar\x7f": `"Foo.Bar"`,
+		"Café Crème":      "=?utf-8?q?Caf=C3=A9_Cr=C3=A8me?=",
+	}
+
+	for name, want := range tests {
+		got := phrase(name)
+		if got != want {
+			t.Errorf("phrase(%q) = %q, want %q", name, got, want)
+		}
+
+		// The phrase must be usable as a display name
+		address, err := mail.ParseAddress(got + " <foo@example.com>")
+		if err != nil {
+			t.Errorf("phrase(%q): %v", name, err)
+			continue
+		}
+		if strings.ContainsAny(name, "\x00\x7f") {
+			continue
+		}
+		if address.Name != name {
+			t.Errorf("phrase(%q): parsed as %q", name, address.Name)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := strings.Repeat("x", 70)
+	tests := []string{
+		"Subject: short",
+		"Subject: " + strings.Repeat("word ", 20),
+		"Subject: " + long + "     " + long,
+		"Subject: " + long + "  " + long + "  ",
+		"Subject: " + long + strings.Repeat(" ", 100),
+		"Subject:" + strings.Repeat(" ", 100) + long,
+		"Subject: " + strings.Repeat("x", 200) + " end",
+	}
+
+	for _, field := range tests {
+		folded := fold(field)
+		if unfolded := strings.Replace(folded, "\r\n", "", -1); unfolded != field {
+			t.Errorf("fold(%q) unfolds to %q", field, unfolded)
+		}
+		for i, line := range strings.Split(folded, "\r\n") {
+			if i > 0 && strings.TrimSpace(line) == "" {
+				t.Errorf("fold(%q) has a whitespace only line %d: %q", field, i, folded)
+			}
+			if i > 0 && line[0] != ' ' {
+				t.Errorf("fold(%q) has a line %d without leading whitespace: %q", field, i, folded)
+			}
+		}
+	}
+}
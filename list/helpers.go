@@ -2,19 +2,21 @@ package list
 
 import (
 	"fmt"
+	"log"
 	"net/mail"
 	"strings"
+	"time"
 )
 
 func (b *bot) isToCommandAddress(msg *Message) bool {
 	if msg.XOriginalTo != "" {
-		return strings.ToLower(msg.XOriginalTo) == b.CommandAddress
+		return canonicalAddress(msg.XOriginalTo) == b.CommandAddress
 	}
 
 	toList, err := mail.ParseAddressList(msg.To)
 	if err == nil {
 		for _, to := range toList {
-			to.Address = strings.ToLower(to.Address)
+			to.Address = canonicalAddress(to.Address)
 			if to.Address == b.CommandAddress {
 				return true
 			}
@@ -24,7 +26,7 @@ func (b *bot) isToCommandAddress(msg *Message) bool {
 	ccList, err := mail.ParseAddressList(msg.Cc)
 	if err == nil {
 		for _, cc := range ccList {
-			cc.Address = strings.ToLower(cc.Address)
+			cc.Address = canonicalAddress(cc.Address)
 			if cc.Address == b.CommandAddress {
 				return true
 			}
@@ -34,7 +36,7 @@ func (b *bot) isToCommandAddress(msg *Message) bool {
 	bccList, err := mail.ParseAddressList(msg.Bcc)
 	if err == nil {
 		for _, bcc := range bccList {
-			bcc.Address = strings.ToLower(bcc.Address)
+			bcc.Address = canonicalAddress(bcc.Address)
 			if bcc.Address == b.CommandAddress {
 				return true
 			}
@@ -64,12 +66,12 @@ func parseBounce(address string) *BounceResponse {
 
 	if len(parts) > 1 {
 		i := strings.LastIndex(parts[1], "=")
-		br.List = fmt.Sprintf("%s@%s", parts[1][:i], parts[1][i+1:])
+		br.List = canonicalAddress(fmt.Sprintf("%s@%s", parts[1][:i], parts[1][i+1:]))
 	}
 
 	if len(parts) > 2 {
 		i := strings.LastIndex(parts[2], "=")
-		br.Address = fmt.Sprintf("%s@%s", parts[2][:i], parts[2][i+1:])
+		br.Address = canonicalAddress(fmt.Sprintf("%s@%s", parts[2][:i], parts[2][i+1:]))
 	}
 
 	return br
@@ -77,7 +79,7 @@ func parseBounce(address string) *BounceResponse {
 
 func (b *bot) isToBounceAddress(msg *Message) *BounceResponse {
 	if msg.XOriginalTo != "" {
-		br := parseBounce(strings.ToLower(msg.XOriginalTo))
+		br := parseBounce(canonicalAddress(msg.XOriginalTo))
 		if br != nil && br.BounceAddress == b.BouncesAddress {
 			return br
 		}
@@ -88,7 +90,7 @@ func (b *bot) isToBounceAddress(msg *Message) *BounceResponse {
 	toList, err := mail.ParseAddressList(msg.To)
 	if err == nil {
 		for _, to := range toList {
-			to.Address = strings.ToLower(to.Address)
+			to.Address = canonicalAddress(to.Address)
 			br := parseBounce(to.Address)
 			if br != nil && br.BounceAddress == b.BouncesAddress {
 				return br
@@ -99,7 +101,7 @@ func (b *bot) isToBounceAddress(msg *Message) *BounceResponse {
 	ccList, err := mail.ParseAddressList(msg.Cc)
 	if err == nil {
 		for _, cc := range ccList {
-			cc.Address = strings.ToLower(cc.Address)
+			cc.Address = canonicalAddress(cc.Address)
 			br := parseBounce(cc.Address)
 			if br != nil && br.BounceAddress == b.BouncesAddress {
 				return br
@@ -110,7 +112,7 @@ func (b *bot) isToBounceAddress(msg *Message) *BounceResponse {
 	bccList, err := mail.ParseAddressList(msg.Bcc)
 	if err == nil {
 		for _, bcc := range bccList {
-			bcc.Address = strings.ToLower(bcc.Address)
+			bcc.Address = canonicalAddress(bcc.Address)
 			br := parseBounce(bcc.Address)
 			if br != nil && br.BounceAddress == b.BouncesAddress {
 				return br
@@ -126,7 +128,7 @@ func (b *bot) lookupLists(msg *Message) ([]*list, error) {
 	lists := []*list{}
 
 	if msg.XOriginalTo != "" {
-		list, err := b.LookupList(strings.ToLower(msg.XOriginalTo))
+		list, err := b.LookupList(canonicalAddress(msg.XOriginalTo))
 		if err != nil {
 			return nil, err
 		}
@@ -140,7 +142,7 @@ func (b *bot) lookupLists(msg *Message) ([]*list, error) {
 	toList, err := mail.ParseAddressList(msg.To)
 	if err == nil {
 		for _, to := range toList {
-			to.Address = strings.ToLower(to.Address)
+			to.Address = canonicalAddress(to.Address)
 			list, err := b.LookupList(to.Address)
 			if err != nil {
 				return nil, err
@@ -154,7 +156,7 @@ func (b *bot) lookupLists(msg *Message) ([]*list, error) {
 	ccList, err := mail.ParseAddressList(msg.Cc)
 	if err == nil {
 		for _, cc := range ccList {
-			cc.Address = strings.ToLower(cc.Address)
+			cc.Address = canonicalAddress(cc.Address)
 			list, err := b.LookupList(cc.Address)
 			if err != nil {
 				return nil, err
@@ -168,7 +170,7 @@ func (b *bot) lookupLists(msg *Message) ([]*list, error) {
 	bccList, err := mail.ParseAddressList(msg.Bcc)
 	if err == nil {
 		for _, bcc := range bccList {
-			bcc.Address = strings.ToLower(bcc.Address)
+			bcc.Address = canonicalAddress(bcc.Address)
 			list, err := b.LookupList(bcc.Address)
 			if err != nil {
 				return nil, err
@@ -191,13 +193,190 @@ func (b *bot) isAdmin(address string) bool {
 	return false
 }
 
+// owners returns the addresses responsible for a list
+func (b *bot) owners(list *list) []string {
+	// Fall back to the global admins for lists without owners
+	if len(list.Owners) == 0 {
+		return b.AdminAddresses
+	}
+	return list.Owners
+}
+
+// isLoop checks whether a message was sent by the list itself, or passed through too many of our lists
+func (b *bot) isLoop(msg *Message, list *list) bool {
+	maxHops := b.MaxHops
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+
+	// Other software adds X-Loop headers too, so only the hops through our own lists are counted
+	hops := 0
+	for _, xLoop := range msg.XLoop {
+		obj, err := mail.ParseAddress(xLoop)
+		if err != nil {
+			continue
+		}
+
+		address := canonicalAddress(obj.Address)
+		if address == list.Address {
+			return true
+		}
+
+		other, err := b.LookupList(address)
+		if err == nil && other != nil {
+			hops++
+		}
+	}
+	return hops >= maxHops
+}
+
+// reportLoop notifies the owners of a list that a message was dropped because of a loop
+func (b *bot) reportLoop(list *list, msg *Message) {
+	message := fmt.Sprintf("A message from %s to the mailing list %s <%s> has been dropped, because it was sent by this list before or passed through too many lists.\n\n"+
+		"Subject: %s\nMessage-Id: %s\nX-Loop: %s\n\n"+
+		"Check whether a subscriber or a bcc address forwards the list back to itself.",
+		msg.From, list.Name, list.Address, msg.Subject, msg.Address, strings.Join(msg.XLoop, ", "))
+
+	for _, owner := range b.owners(list) {
+		err := b.notify(owner, fmt.Sprintf("Mail loop detected on %s", list.Address), message)
+		if err != nil {
+			log.Printf("NOTIFICATION_FAILED To=%q listAddress=%q Error=%s\n", owner, list.Address, err.Error())
+		}
+	}
+}
+
+// role determines the role of an address for a list, which can be nil
+func (b *bot) role(address string, list *list) Role {
+	if b.isAdmin(address) {
+		return RoleAdmin
+	}
+
+	if list == nil {
+		return RoleUser
+	}
+
+	for _, a := range list.Owners {
+		if a == address {
+			return RoleOwner
+		}
+	}
+
+	for _, a := range list.Moderators {
+		if a == address {
+			return RoleModerator
+		}
+	}
+
+	return RoleUser
+}
+
 func (b *bot) reply(msg *Message, message string) error {
+	if reason := b.suppressReply(msg); reason != "" {
+		log.Printf("REPLY_SUPPRESSED To=%q Subject=%q Reason=%q Message=%s\n", msg.From, msg.Subject, reason, strings.Replace(message, "\n", " ", -1))
+		return nil
+	}
+
 	message = strings.Replace(message, "\n", "\r\n", -1)
 	message = fmt.Sprintf("%s\r\n", message)
 
 	reply := msg.Reply()
 	reply.From = b.CommandAddress
+	reply.Address = newMessageID(b.CommandAddress)
 	reply.Body = []byte(message)
 
-	return reply.Send(b.CommandAddress, []string{msg.From}, b.SMTPHostname, b.SMTPPort, b.SMTPUsername, b.SMTPPassword, b.Debug)
+	err := reply.Send(b.CommandAddress, []string{msg.From}, b.Config)
+	if err != nil {
+		return err
+	}
+
+	if obj, err := mail.ParseAddress(msg.From); err == nil {
+		return b.AddReply(canonicalAddress(obj.Address), time.Now())
+	}
+	return nil
+}
+
+// suppressReply returns the reason why a reply to a message would be backscatter, or an empty string
+func (b *bot) suppressReply(msg *Message) string {
+	if reason := isAutomated(msg); reason != "" {
+		return reason
+	}
+
+	obj, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return "invalid sender"
+	}
+
+	if b.rateLimited(canonicalAddress(obj.Address)) {
+		return "rate limit"
+	}
+
+	return ""
+}
+
+// rateLimited returns whether the replies sent to an address in the last ReplyInterval reached the reply limit
+func (b *bot) rateLimited(address string) bool {
+	limit := b.ReplyLimit
+	if limit <= 0 {
+		limit = DefaultReplyLimit
+	}
+
+	n, err := b.CountReplies(address, time.Now().Add(-ReplyInterval))
+	if err != nil {
+		log.Printf("REPLY_COUNT_FAILED To=%q Error=%s\n", address, err.Error())
+		return false
+	}
+
+	return n >= limit
+}
+
+// isAutomated returns the reason why a message looks like it was generated automatically, or an empty string
+func isAutomated(msg *Message) string {
+	if autoSubmitted := strings.TrimSpace(msg.AutoSubmitted); autoSubmitted != "" && !strings.EqualFold(autoSubmitted, "no") {
+		return "auto-submitted"
+	}
+
+	switch strings.ToLower(strings.TrimSpace(msg.Precedence)) {
+	case "bulk", "list", "junk":
+		return "precedence"
+	}
+
+	if msg.ListID != "" {
+		return "list message"
+	}
+
+	for _, returnPath := range msg.Headers.Values("Return-Path") {
+		if strings.TrimSpace(returnPath) == "<>" {
+			return "null sender"
+		}
+	}
+
+	obj, err := mail.ParseAddress(msg.From)
+	if err != nil || obj.Address == "" {
+		return "null sender"
+	}
+
+	if strings.HasPrefix(strings.ToLower(obj.Address), "mailer-daemon@") {
+		return "mailer daemon"
+	}
+
+	return ""
+}
+
+func (b *bot) notify(to string, subject string, message string) error {
+	message = strings.Replace(message, "\n", "\r\n", -1)
+	message = fmt.Sprintf("%s\r\n", message)
+
+	msg := &Message{}
+	msg.Subject = subject
+	msg.From = b.CommandAddress
+	msg.To = to
+	msg.Date = time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700")
+	msg.Address = newMessageID(b.CommandAddress)
+	msg.AutoSubmitted = "auto-generated"
+	msg.MIMEVersion = "1.0"
+	msg.ContentType = "text/plain; charset=utf-8"
+	msg.Headers = Header{}
+	msg.Body = []byte(message)
+
+	return msg.Send(b.CommandAddress, []string{to}, b.Config)
 }
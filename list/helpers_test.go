@@ -0,0 +1,41 @@
+package list
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIsLoop(t *testing.T) {
+	lists := []Definition{}
+	for i := 0; i < 6; i++ {
+		lists = append(lists, Definition{Address: fmt.Sprintf("list%d@example.com", i)})
+	}
+	b := NewBot(newMemoryBackend(Config{MaxHops: 3}, lists...))
+
+	list, err := b.LookupList("list0@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		xLoop []string
+		loop  bool
+	}{
+		{nil, false},
+		{[]string{"list0@example.com"}, true},
+		{[]string{"List0@Example.com"}, true},
+		{[]string{"Foo <list0@example.com>"}, true},
+		{[]string{"list1@example.com", "list2@example.com"}, false},
+		{[]string{"list1@example.com", "list2@example.com", "list3@example.com"}, true},
+		// procmail and other software add X-Loop headers of their own
+		{[]string{"bob@example.net", "bob@example.net", "bob@example.net", "vacation"}, false},
+		{[]string{"list1@example.com", "other@example.org", "list2@example.com", "other@example.org"}, false},
+	}
+
+	for _, test := range tests {
+		msg := &Message{XLoop: test.xLoop}
+		if loop := b.isLoop(msg, list); loop != test.loop {
+			t.Errorf("isLoop(%q) = %v, want %v", test.xLoop, loop, test.loop)
+		}
+	}
+}
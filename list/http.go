@@ -0,0 +1,84 @@
+package list
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Unsubscribe</title></head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{else}}<form method="post">
+<p>Unsubscribe {{.Address}} from {{.List}}?</p>
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<input type="submit" value="Unsubscribe">
+</form>{{end}}
+</body>
+</html>
+`))
+
+// ServeHTTP handles one-click unsubscribe requests as described in RFC 8058
+func (b *bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		listAddress = r.URL.Query().Get("list")
+		address     = r.URL.Query().Get("address")
+		token       = r.URL.Query().Get("token")
+	)
+
+	page := struct {
+		List    string
+		Address string
+		Message string
+	}{
+		List:    listAddress,
+		Address: address,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	// Without a secret, anyone could unsubscribe any member
+	if b.Secret == "" {
+		log.Printf("UNSUBSCRIBE_FAILED User=%q List=%q Error=%s\n", address, listAddress, ErrNoSecret.Error())
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		page.Message = "Unsubscribing is not available."
+		unsubscribePage.Execute(w, page)
+		return
+	}
+
+	err := verifyToken(b.Secret, token, "unsubscribe", listAddress, address)
+	if err != nil {
+		log.Printf("UNSUBSCRIBE_FAILED User=%q List=%q Error=%s\n", address, listAddress, err.Error())
+
+		w.WriteHeader(http.StatusForbidden)
+		page.Message = fmt.Sprintf("Unable to unsubscribe: %s", err.Error())
+		unsubscribePage.Execute(w, page)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Link scanners follow links, so only unsubscribe after an explicit POST
+		unsubscribePage.Execute(w, page)
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := b.Unsubscribe(address, listAddress, false)
+	if err != nil {
+		log.Printf("UNSUBSCRIBE_FAILED User=%q List=%q Error=%s\n", address, listAddress, err.Error())
+
+		page.Message = err.Error()
+		unsubscribePage.Execute(w, page)
+		return
+	}
+
+	page.Message = fmt.Sprintf("%s is now unsubscribed from %s.", address, list.Address)
+	unsubscribePage.Execute(w, page)
+}
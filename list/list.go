@@ -2,47 +2,181 @@ package list
 
 import (
 	"fmt"
+	"log"
 	"math"
+	"net/mail"
+	"net/url"
 	"strings"
+	"text/template"
 	"time"
 )
 
 // BounceInterval is used to compute ban times when bouncing.
 const BounceInterval = 7 * 24 * time.Hour
 
+// ConfirmationInterval is the time a subscription request remains valid without confirmation.
+const ConfirmationInterval = 3 * 24 * time.Hour
+
+// HoldInterval is the time a held message awaits moderation before it expires.
+const HoldInterval = 14 * 24 * time.Hour
+
+// UnsubscribeInterval is the time an unsubscribe link in a sent message remains valid.
+const UnsubscribeInterval = 365 * 24 * time.Hour
+
 // A Definition defines a list definition.
 type Definition struct {
-	Address         string   `ini:"address"`
-	Name            string   `ini:"name"`
-	Description     string   `ini:"description"`
-	Hidden          bool     `ini:"hidden"`
-	Locked          bool     `ini:"locked"`
-	SubscribersOnly bool     `ini:"subscribers_only"`
-	Posters         []string `ini:"posters,omitempty"`
-	Bcc             []string `ini:"bcc,omitempty"`
+	Address         string           `ini:"address"`
+	Name            string           `ini:"name"`
+	Description     string           `ini:"description"`
+	Hidden          bool             `ini:"hidden"`
+	Locked          bool             `ini:"locked"`
+	SubscribersOnly bool             `ini:"subscribers_only"`
+	Authenticated   bool             `ini:"authenticated"`
+	Moderation      ModerationPolicy `ini:"moderation"`
+	SubjectPrefix   string           `ini:"subject_prefix"`
+	Footer          string           `ini:"footer"`
+	DMARCMitigation MitigationPolicy `ini:"dmarc_mitigation"`
+	ReplyTo         ReplyToPolicy    `ini:"reply_to"`
+	ReplyToAddress  string           `ini:"reply_to_address"`
+	MergeReplyTo    bool             `ini:"merge_reply_to"`
+	DKIMDomain      string           `ini:"dkim_domain"`
+	DKIMSelector    string           `ini:"dkim_selector"`
+	DKIMKey         string           `ini:"dkim_key"`
+	ArchiveURL      string           `ini:"archive_url"`
+	HelpURL         string           `ini:"help_url"`
+	OwnerURL        string           `ini:"owner_url"`
+	Posters         []string         `ini:"posters,omitempty"`
+	Bcc             []string         `ini:"bcc,omitempty"`
+	Owners          []string         `ini:"owners,omitempty"`
+	Moderators      []string         `ini:"moderators,omitempty"`
 }
 
 func (def Definition) String() string {
-	return fmt.Sprintf("%s <%s>: %s\nHidden: %v | Locked: %v | Subscribers only: %v\nPosters: %s\nBcc: %s",
-		def.Name, def.Address, def.Description, def.Hidden, def.Locked, def.SubscribersOnly, strings.Join(def.Posters, ", "), strings.Join(def.Bcc, ", "))
+	return fmt.Sprintf("%s <%s>: %s\nHidden: %v | Locked: %v | Subscribers only: %v | Authenticated: %v | Moderation: %s | DMARC mitigation: %s\nReply-To: %s %s | Merge Reply-To: %v\nSubject prefix: %s\nDKIM: %s %s %s\nArchive: %s | Help: %s | Owner: %s\nFooter:\n%s\nPosters: %s\nBcc: %s\nOwners: %s\nModerators: %s",
+		def.Name, def.Address, def.Description, def.Hidden, def.Locked, def.SubscribersOnly, def.Authenticated, def.Moderation, def.DMARCMitigation, def.ReplyTo, def.ReplyToAddress, def.MergeReplyTo, def.SubjectPrefix, def.DKIMDomain, def.DKIMSelector, def.DKIMKey, def.ArchiveURL, def.HelpURL, def.OwnerURL, def.Footer, strings.Join(def.Posters, ", "), strings.Join(def.Bcc, ", "), strings.Join(def.Owners, ", "), strings.Join(def.Moderators, ", "))
 }
 
+// A Role determines the commands a user can execute for a list
+type Role int
+
+// Roles, in increasing order of privileges
+const (
+	// RoleUser can manage its own subscriptions
+	RoleUser Role = iota
+	// RoleModerator can also approve or reject held messages
+	RoleModerator
+	// RoleOwner can also modify the list and manage its subscribers
+	RoleOwner
+	// RoleAdmin can also create and delete lists
+	RoleAdmin
+)
+
+// A ModerationPolicy determines what happens to posts of unauthorised posters
+type ModerationPolicy string
+
+// Moderation policies
+const (
+	// PolicyReject rejects the post and notifies the poster
+	PolicyReject ModerationPolicy = "reject"
+	// PolicyHold keeps the post until a moderator approves or rejects it
+	PolicyHold ModerationPolicy = "hold"
+	// PolicyDiscard drops the post silently
+	PolicyDiscard ModerationPolicy = "discard"
+)
+
+// A MitigationPolicy determines when the From header of posts is rewritten to pass DMARC checks
+type MitigationPolicy string
+
+// DMARC mitigation policies
+const (
+	// MitigateNone keeps the From header of the poster
+	MitigateNone MitigationPolicy = "none"
+	// MitigateAlways rewrites the From header of every post
+	MitigateAlways MitigationPolicy = "always"
+	// MitigatePolicy rewrites the From header if the domain of the poster publishes a reject or quarantine policy
+	MitigatePolicy MitigationPolicy = "policy"
+)
+
+// A ReplyToPolicy determines where replies to posts are sent
+type ReplyToPolicy string
+
+// Reply-To policies
+const (
+	// ReplyToPoster keeps the Reply-To header of the poster
+	ReplyToPoster ReplyToPolicy = "poster"
+	// ReplyToList sends replies to the list
+	ReplyToList ReplyToPolicy = "list"
+	// ReplyToFixed sends replies to the ReplyToAddress of the list
+	ReplyToFixed ReplyToPolicy = "address"
+)
+
+// A DeliveryMode determines how a subscriber receives the posts to a list
+type DeliveryMode string
+
+// Delivery modes
+const (
+	// ModeRegular delivers every post when it is sent
+	ModeRegular DeliveryMode = "regular"
+	// ModeDigest collects posts in periodic digests
+	ModeDigest DeliveryMode = "digest"
+	// ModeNoMail keeps the subscription, but doesn't deliver posts
+	ModeNoMail DeliveryMode = "nomail"
+)
+
 // Subscription describes a subscription with metadata
 type Subscription struct {
 	Address    string
+	Mode       DeliveryMode
 	Bounces    uint16
 	LastBounce time.Time
 }
 
+// PendingSubscription describes a subscription request awaiting confirmation
+type PendingSubscription struct {
+	List    string
+	Address string
+	Token   string
+	Expires time.Time
+}
+
+// ArchivedMessage describes a message stored in the archive of a list
+type ArchivedMessage struct {
+	ID      string
+	Sender  string
+	Subject string
+	Date    time.Time
+	Message []byte
+}
+
+// HeldMessage describes a post awaiting moderation
+type HeldMessage struct {
+	List    string
+	Token   string
+	Sender  string
+	Subject string
+	Expires time.Time
+	Message []byte
+	// Results are the results of the authentication checks when the message was received
+	Results []string
+}
+
 // List represents a mailing list
 type list struct {
 	Definition
-	Subscribe    func(string) error
-	Unsubscribe  func(string) error
-	SetBounce    func(string, uint16, time.Time) error
-	Subscribers  func() ([]Subscription, error)
-	IsSubscribed func(string) (*Subscription, error)
-	Archive      func(*Message) error
+	Subscribe     func(string) error
+	AddPending    func(string, string, time.Time) error
+	Pending       func(string) (*PendingSubscription, error)
+	Unsubscribe   func(string) error
+	SetMode       func(string, DeliveryMode) error
+	SetBounce     func(string, uint16, time.Time) error
+	Subscribers   func() ([]Subscription, error)
+	IsSubscribed  func(string) (*Subscription, error)
+	Archive       func(*Message) error
+	Hold          func(HeldMessage) error
+	Archived      func(time.Time, time.Time) ([]ArchivedMessage, error)
+	LastDigest    func() (time.Time, error)
+	SetLastDigest func(time.Time) error
+	Enqueue       func(QueuedMessage) error
 }
 
 // CanPost checks if the user is authorised to post to this mailing list
@@ -73,38 +207,215 @@ func (list *list) CanPost(from string) bool {
 	return policy
 }
 
-// Send a message to the mailing list
-func (list *list) Send(msg *Message, envelopeSender string, SMTPHostname string, SMTPPort uint64, SMTPUsername string, SMTPPassword string, debug bool) error {
-	// Archive message if configured
+// Send a message to the mailing list. Deliveries that fail are queued, see send.
+// It returns the number of deliveries that are queued for a retry.
+func (list *list) Send(msg *Message, config Config) (int, error) {
+	config = list.sendConfig(config)
+
+	// Collect recipients
+	recipients, err := list.recipients(ModeRegular)
+	if err != nil {
+		return 0, err
+	}
+	for _, bcc := range list.Bcc {
+		recipients = append(recipients, bcc)
+	}
+
+	// Send using VERP
+	return list.send(msg, recipients, config)
+}
+
+// SendDigest sends a digest to the subscribers in digest mode, and reports whether it was handed to the SMTP server
+func (list *list) SendDigest(msg *Message, config Config) (bool, error) {
+	config = list.sendConfig(config)
+
+	_, err := list.envelopeSender(config)
+	if err != nil {
+		return false, err
+	}
+
+	recipients, err := list.recipients(ModeDigest)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = list.send(msg, recipients, config)
+	return true, err
+}
+
+// replyTo returns the Reply-To header of a post, given the Reply-To header of the poster
+func (list *list) replyTo(original string) string {
+	var replyTo string
+	switch list.ReplyTo {
+	case ReplyToList:
+		replyTo = (&mail.Address{Name: list.Name, Address: list.Address}).String()
+	case ReplyToFixed:
+		replyTo = list.ReplyToAddress
+	default:
+		return original
+	}
+
+	if !list.MergeReplyTo {
+		return replyTo
+	}
+
+	return mergeAddress(original, replyTo)
+}
+
+// mergeAddress appends an address to an address list header, unless it is already there
+func mergeAddress(original string, address string) string {
+	if original == "" {
+		return address
+	}
+
+	addresses, err := mail.ParseAddressList(original)
+	if err == nil {
+		target, err := mail.ParseAddress(address)
+		for _, a := range addresses {
+			if err == nil && strings.EqualFold(a.Address, target.Address) {
+				return original
+			}
+		}
+	}
+
+	return original + ", " + address
+}
+
+// id returns the list identifier (RFC 2919): the list address with the @ replaced by a dot
+func (list *list) id() string {
+	address, _ := asciiAddress(list.Address)
+	return strings.Replace(address, "@", ".", 1)
+}
+
+// url returns the URL configured for the list, or the global one. A {list}
+// in the global URL is replaced by the list address.
+func (list *list) url(url string, global string) string {
+	if url != "" {
+		return url
+	}
+	return strings.Replace(global, "{list}", list.Address, -1)
+}
+
+// sendConfig returns the configuration to send messages of the list, using the DKIM key of the list if it has one
+func (list *list) sendConfig(config Config) Config {
+	if list.DKIMKey != "" {
+		config.DKIMDomain = list.DKIMDomain
+		config.DKIMSelector = list.DKIMSelector
+		config.DKIMKey = list.DKIMKey
+		if config.DKIMDomain == "" {
+			config.DKIMDomain = list.Address[strings.LastIndex(list.Address, "@")+1:]
+		}
+	}
+	return config
+}
 
-	// Append list id to envelope sender
-	parts := strings.SplitN(envelopeSender, "@", 2)
+// envelopeSender appends the list id to the bounces address
+func (list *list) envelopeSender(config Config) (string, error) {
+	parts := strings.SplitN(config.BouncesAddress, "@", 2)
 	if len(parts) < 2 {
-		return fmt.Errorf("Invalid envelope sender %s", envelopeSender)
+		return "", fmt.Errorf("Invalid envelope sender %s", config.BouncesAddress)
 	}
-	envelopeSender = fmt.Sprintf("%s+%s@%s", parts[0], strings.Replace(list.Address, "@", "=", 1), parts[1])
+	return fmt.Sprintf("%s+%s@%s", parts[0], strings.Replace(list.Address, "@", "=", 1), parts[1]), nil
+}
 
-	// Collect recipients
+// recipients returns the active subscribers in the given delivery mode
+func (list *list) recipients(mode DeliveryMode) ([]string, error) {
 	recipients := []string{}
 	subscriptions, err := list.Subscribers()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, subscription := range subscriptions {
+		if subscription.Mode != mode {
+			continue
+		}
 		ok, err := list.CheckBounces(subscription)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if ok {
 			recipients = append(recipients, subscription.Address)
 		}
 	}
-	for _, bcc := range list.Bcc {
-		recipients = append(recipients, bcc)
+	return recipients, nil
+}
+
+// personalizer returns a function that gives the copy of a message to be sent to
+// a single recipient. The footer template is parsed once for all recipients, and
+// the body they share is built and hashed once.
+func (list *list) personalizer(msg *Message, config Config) func(string) *Message {
+	var (
+		footer *template.Template
+		end    []byte
+	)
+	if list.Footer != "" {
+		var err error
+		footer, err = parseFooter(list.Footer)
+		if err == nil {
+			msg, end, err = msg.withFooterPart()
+		}
+		if err != nil {
+			// Rather send the post without footer than not at all
+			log.Printf("FOOTER_FAILED listAddress=%q Error=%s\n", list.Address, err.Error())
+			footer = nil
+		}
 	}
 
-	// Send using VERP
-	return msg.SendVERP(envelopeSender, recipients, SMTPHostname, SMTPPort, SMTPUsername, SMTPPassword, debug)
+	// The copies are prepared concurrently, so hash their body before they share it
+	if config.DKIMKey != "" {
+		msg.relaxedBodyHash()
+	}
+
+	return func(recipient string) *Message {
+		return list.personalize(msg, recipient, footer, end, config)
+	}
+}
+
+// personalize returns the copy of a message to be sent to a single recipient. With
+// a footer template, the body of the message ends in a footer part, followed by the
+// rendered footer and end in the trailer of the copy.
+func (list *list) personalize(msg *Message, recipient string, footerTemplate *template.Template, end []byte, config Config) *Message {
+	send := *msg
+
+	var unsubscribeURL string
+	if config.UnsubscribeURL != "" {
+		// One-click unsubscribe link as described in RFC 8058
+		values := url.Values{}
+		values.Set("list", list.Address)
+		values.Set("address", recipient)
+		values.Set("token", signToken(config.Secret, time.Now().Add(UnsubscribeInterval), "unsubscribe", list.Address, recipient))
+
+		separator := "?"
+		if strings.Contains(config.UnsubscribeURL, "?") {
+			separator = "&"
+		}
+		unsubscribeURL = config.UnsubscribeURL + separator + values.Encode()
+
+		send.ListUnsubscribe = fmt.Sprintf("<%s>", unsubscribeURL)
+		if msg.ListUnsubscribe != "" {
+			send.ListUnsubscribe += ", " + msg.ListUnsubscribe
+		}
+		send.ListUnsubscribePost = "List-Unsubscribe=One-Click"
+	}
+
+	if footerTemplate == nil {
+		return &send
+	}
+
+	footer, err := renderFooter(footerTemplate, FooterData{
+		List:           list.Definition,
+		Recipient:      recipient,
+		CommandAddress: config.CommandAddress,
+		UnsubscribeURL: unsubscribeURL,
+	})
+	if err != nil {
+		// Rather send the post with an empty footer than not at all
+		log.Printf("FOOTER_FAILED listAddress=%q To=%q Error=%s\n", list.Address, recipient, err.Error())
+		footer = ""
+	}
+
+	send.trailer = footerTrailer(footer, end)
+	return &send
 }
 
 func (list *list) String() string {
@@ -113,9 +424,9 @@ func (list *list) String() string {
 	for _, subscription := range subscribers {
 		ok, _ := list.CheckBounces(subscription)
 		if ok {
-			out += fmt.Sprintf("\n  - %s (%d bounces, last on %s)", subscription.Address, subscription.Bounces, subscription.LastBounce)
+			out += fmt.Sprintf("\n  - %s (%s, %d bounces, last on %s)", subscription.Address, subscription.Mode, subscription.Bounces, subscription.LastBounce)
 		} else {
-			out += fmt.Sprintf("\n  - %s (disabled, %d bounces, last on %s)", subscription.Address, subscription.Bounces, subscription.LastBounce)
+			out += fmt.Sprintf("\n  - %s (%s, disabled, %d bounces, last on %s)", subscription.Address, subscription.Mode, subscription.Bounces, subscription.LastBounce)
 		}
 	}
 	return out
@@ -0,0 +1,28 @@
+package list
+
+import "testing"
+
+func TestReplyTo(t *testing.T) {
+	tests := []struct {
+		definition Definition
+		original   string
+		replyTo    string
+	}{
+		{Definition{Address: "list@example.com", Name: "List", ReplyTo: ReplyToPoster}, "bob@example.net", "bob@example.net"},
+		{Definition{Address: "list@example.com", Name: "List", ReplyTo: ReplyToList}, "bob@example.net", `"List" <list@example.com>`},
+		{Definition{Address: "list@example.com", ReplyTo: ReplyToList}, "", "<list@example.com>"},
+		{Definition{Address: "list@example.com", Name: "Smith, Jones & co", ReplyTo: ReplyToList}, "", `"Smith, Jones & co" <list@example.com>`},
+		{Definition{Address: "list@example.com", Name: `Say "hi"`, ReplyTo: ReplyToList}, "", `"Say \"hi\"" <list@example.com>`},
+		{Definition{Address: "list@example.com", Name: "Café", ReplyTo: ReplyToList}, "", "=?utf-8?q?Caf=C3=A9?= <list@example.com>"},
+		{Definition{Address: "list@example.com", Name: "A, B", ReplyTo: ReplyToList, MergeReplyTo: true}, "bob@example.net", `bob@example.net, "A, B" <list@example.com>`},
+		{Definition{Address: "list@example.com", Name: "A, B", ReplyTo: ReplyToList, MergeReplyTo: true}, "List <LIST@example.com>", "List <LIST@example.com>"},
+		{Definition{Address: "list@example.com", ReplyTo: ReplyToFixed, ReplyToAddress: "help@example.com"}, "bob@example.net", "help@example.com"},
+	}
+
+	for _, test := range tests {
+		list := &list{Definition: test.definition}
+		if replyTo := list.replyTo(test.original); replyTo != test.replyTo {
+			t.Errorf("replyTo(%q) with %q = %q, want %q", test.original, test.definition.Name, replyTo, test.replyTo)
+		}
+	}
+}
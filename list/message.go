@@ -2,80 +2,115 @@ package list
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/mail"
 	"net/smtp"
-	"net/textproto"
-	"sort"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // Message represents an e-mail message
 type Message struct {
-	XOriginalTo     string
-	Subject         string
-	From            string
-	To              string
-	Cc              string
-	Bcc             string
-	Date            string
-	Sender          string
-	Address         string
-	InReplyTo       string
-	Precedence      string
-	ListID          string
-	ListUnsubscribe string
-	ListSubscribe   string
-	ListArchive     string
-	ListOwner       string
-	ListHelp        string
-	XMailingList    string
-	XLoop           string
-	MIMEVersion     string
-	ContentType     string
-	Headers         map[string][]string
-	Body            []byte
+	XOriginalTo         string
+	Subject             string
+	From                string
+	To                  string
+	Cc                  string
+	Bcc                 string
+	ReplyTo             string
+	Date                string
+	Sender              string
+	Address             string
+	InReplyTo           string
+	Precedence          string
+	AutoSubmitted       string
+	ListID              string
+	ListUnsubscribe     string
+	ListUnsubscribePost string
+	ListSubscribe       string
+	ListPost            string
+	ListArchive         string
+	ListOwner           string
+	ListHelp            string
+	XMailingList        string
+	XLoop               []string
+	MIMEVersion         string
+	ContentType         string
+	Headers             Header
+	Body                []byte
+
+	// trailer is sent after the body: the copies of a post share the body, and differ in their trailer
+	trailer []byte
+	// bodyHash is the hash of the body, which the copies of the message share
+	bodyHash *bodyHash
+	// raw holds the data the message was parsed from, signatures are validated against it
+	raw []byte
+	// arc is the ARC set to add when the message is sent
+	arc *arcSet
+	// auth holds the authentication results of a received message
+	auth *authentication
 }
 
 // FromReader reads a message from the given io.Reader
 func (msg *Message) FromReader(stream io.Reader) error {
-	inMessage, err := mail.ReadMessage(stream)
+	data, err := ioutil.ReadAll(stream)
 	if err != nil {
 		return err
 	}
 
-	body, err := ioutil.ReadAll(inMessage.Body)
+	return msg.parse(data)
+}
+
+// parse parses a serialized message. The body refers to the given data, it is not copied.
+func (msg *Message) parse(data []byte) error {
+	fields, body := splitMessage(data)
+	header, err := parseHeader(fields)
 	if err != nil {
 		return err
 	}
 
-	header := textproto.MIMEHeader(inMessage.Header)
+	// These fields occur at most once (RFC 5322). With more, the one that is used
+	// could differ from the one that is covered by a DKIM signature.
+	for _, key := range []string{"From", "Sender", "Reply-To", "Subject"} {
+		if n := len(header.Values(key)); n > 1 {
+			return fmt.Errorf("The message has %d %s header fields", n, key)
+		}
+	}
+
 	msg.XOriginalTo = header.Get("X-Original-To")
 	msg.Subject = header.Get("Subject")
 	msg.From = header.Get("From")
 	msg.To = header.Get("To")
 	msg.Cc = header.Get("Cc")
 	msg.Bcc = header.Get("Bcc")
+	msg.ReplyTo = header.Get("Reply-To")
 	msg.Date = header.Get("Date")
 	msg.Sender = header.Get("Sender")
 	msg.Address = header.Get("Message-Id")
 	msg.InReplyTo = header.Get("In-Reply-To")
 	msg.Precedence = header.Get("Precedence")
+	msg.AutoSubmitted = header.Get("Auto-Submitted")
 	msg.ListID = header.Get("List-Id")
 	msg.ListUnsubscribe = header.Get("List-Unsubscribe")
+	msg.ListUnsubscribePost = header.Get("List-Unsubscribe-Post")
 	msg.ListSubscribe = header.Get("List-Subscribe")
+	msg.ListPost = header.Get("List-Post")
 	msg.ListOwner = header.Get("List-Owner")
 	msg.ListArchive = header.Get("List-Archive")
 	msg.ListHelp = header.Get("List-Help")
 	msg.XMailingList = header.Get("X-Mailing-List")
-	msg.XLoop = header.Get("X-Loop")
+	msg.XLoop = header.Values("X-Loop")
 	msg.MIMEVersion = header.Get("MIME-Version")
 	msg.ContentType = header.Get("Content-Type")
 	msg.Body = body
+	msg.raw = data
 
 	header.Del("X-Original-To")
 	header.Del("Subject")
@@ -83,14 +118,18 @@ func (msg *Message) FromReader(stream io.Reader) error {
 	header.Del("To")
 	header.Del("Cc")
 	header.Del("Bcc")
+	header.Del("Reply-To")
 	header.Del("Date")
 	header.Del("Sender")
 	header.Del("Message-Id")
 	header.Del("In-Reply-To")
 	header.Del("Precedence")
+	header.Del("Auto-Submitted")
 	header.Del("List-Id")
 	header.Del("List-Unsubscribe")
+	header.Del("List-Unsubscribe-Post")
 	header.Del("List-Subscribe")
+	header.Del("List-Post")
 	header.Del("List-Owner")
 	header.Del("List-Archive")
 	header.Del("List-Help")
@@ -99,7 +138,7 @@ func (msg *Message) FromReader(stream io.Reader) error {
 	header.Del("MIME-Version")
 	header.Del("Content-Type")
 
-	msg.Headers = map[string][]string(header)
+	msg.Headers = header
 
 	return nil
 }
@@ -111,33 +150,65 @@ func (msg *Message) Reply() *Message {
 	reply.To = msg.From
 	reply.InReplyTo = msg.Address
 	reply.Date = time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700")
+	reply.AutoSubmitted = "auto-replied"
 	reply.MIMEVersion = "1.0"
 	reply.ContentType = "text/plain; charset=utf-8"
-	reply.Headers = map[string][]string{}
+	reply.Headers = Header{}
+	if references := msg.references(); len(references) > 0 {
+		reply.Headers.Set("References", strings.Join(references, " "))
+	}
 	reply.Body = []byte{}
 	return reply
 }
 
+// references returns the References of a reply to the message (RFC 5322 section 3.6.4):
+// the References of the message, or its In-Reply-To if it has a single identifier,
+// followed by its Message-Id
+func (msg *Message) references() []string {
+	references := strings.Fields(msg.Headers.Get("References"))
+	if len(references) == 0 {
+		if inReplyTo := strings.Fields(msg.InReplyTo); len(inReplyTo) == 1 {
+			references = inReplyTo
+		}
+	}
+	if msg.Address != "" {
+		references = append(references, msg.Address)
+	}
+	return references
+}
+
+// messageIDs counts the Message-Ids generated without randomness
+var messageIDs uint64
+
+// newMessageID generates a unique Message-Id in the domain of the given address
+func newMessageID(address string) string {
+	address, _ = asciiAddress(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		// Fall back to an identifier that is unique by time and process
+		return fmt.Sprintf("<%d.%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&messageIDs, 1), domain)
+	}
+
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
 // ResendAs a list prepares a copy of the message to be used for a list forward
-func (msg *Message) ResendAs(list *list, commandAddress string) *Message {
+func (msg *Message) ResendAs(list *list, config Config) *Message {
 	send := &Message{}
 
-	listID := fmt.Sprintf("%s <%s>", list.Name, list.Address)
-
-	send.Subject = msg.Subject
+	send.Subject = prefixSubject(msg.Subject, list.SubjectPrefix)
 	send.From = msg.From
 	send.To = msg.To
 	send.Cc = msg.Cc
+	send.ReplyTo = list.replyTo(msg.ReplyTo)
 	send.Date = msg.Date
-	send.Sender = listID
 	send.Address = msg.Address
 	send.InReplyTo = msg.InReplyTo
-	send.Precedence = "bulk"
-	send.ListID = listID
-	send.ListUnsubscribe = fmt.Sprintf("<mailto:%s?subject=unsubscribe%%20%s>", commandAddress, list.Address)
-	send.ListSubscribe = fmt.Sprintf("<mailto:%s?subject=subscribe%%20%s>", commandAddress, list.Address)
-	send.XMailingList = listID
-	send.XLoop = listID
+	send.AutoSubmitted = msg.AutoSubmitted
+	send.XLoop = msg.XLoop
+	send.setListHeaders(list, config)
 	send.MIMEVersion = msg.MIMEVersion
 	send.ContentType = msg.ContentType
 	send.Body = msg.Body
@@ -146,7 +217,7 @@ func (msg *Message) ResendAs(list *list, commandAddress string) *Message {
 	bccList, err := mail.ParseAddressList(msg.Bcc)
 	if err == nil {
 		for _, bcc := range bccList {
-			bcc.Address = strings.ToLower(bcc.Address)
+			bcc.Address = canonicalAddress(bcc.Address)
 			if bcc.Address == list.Address {
 				send.Bcc = list.Name + " <" + list.Address + ">"
 				break
@@ -154,13 +225,11 @@ func (msg *Message) ResendAs(list *list, commandAddress string) *Message {
 		}
 	}
 
-	// Copy other headers unmodified (e.g. DKIM signatures)
-	send.Headers = map[string][]string{}
-	for key, values := range msg.Headers {
-		canonicKey := textproto.CanonicalMIMEHeaderKey(key)
-
+	// Copy other headers unmodified (e.g. DKIM signatures), keeping their folding and order
+	send.Headers = Header{}
+	for _, field := range msg.Headers {
 		// Filter keys
-		switch canonicKey {
+		switch field.Key {
 		case "Received":
 			continue
 		case "X-Original-To":
@@ -171,12 +240,6 @@ func (msg *Message) ResendAs(list *list, commandAddress string) *Message {
 			continue
 		case "Return-Path":
 			continue
-		case "Arc-Authentication-Results":
-			continue
-		case "Arc-Message-Signature":
-			continue
-		case "Arc-Seal":
-			continue
 		case "X-Spamd-Result":
 			continue
 		case "X-Rspamd-Server":
@@ -184,144 +247,292 @@ func (msg *Message) ResendAs(list *list, commandAddress string) *Message {
 		}
 
 		// Keys with spaces are probably malformed
-		if strings.Contains(canonicKey, " ") {
+		if strings.Contains(field.Key, " ") {
 			continue
 		}
 
-		for index, value := range values {
-			// If value contains newline, strip it
-			i := strings.IndexAny(value, "\r\n")
-			if i >= 0 {
-				values[index] = value[:i]
-			}
-		}
-
-		send.Headers[canonicKey] = values
+		send.Headers = append(send.Headers, field)
 	}
 
 	return send
 }
 
+// setListHeaders sets the headers that identify a message as sent by a list (RFC 2369 and RFC 2919)
+func (msg *Message) setListHeaders(list *list, config Config) {
+	commandAddress := config.CommandAddress
+	listAddress := (&mail.Address{Name: list.Name, Address: list.Address}).String()
+
+	msg.Sender = listAddress
+	msg.Precedence = "bulk"
+	msg.ListID = fmt.Sprintf("<%s>", list.id())
+	if list.Name != "" {
+		msg.ListID = phrase(list.Name) + " " + msg.ListID
+	}
+	msg.ListUnsubscribe = fmt.Sprintf("<mailto:%s?subject=unsubscribe%%20%s>", commandAddress, list.Address)
+	msg.ListSubscribe = fmt.Sprintf("<mailto:%s?subject=subscribe%%20%s>", commandAddress, list.Address)
+	msg.ListPost = fmt.Sprintf("<mailto:%s>", list.Address)
+	msg.ListHelp = fmt.Sprintf("<mailto:%s?subject=help>", commandAddress)
+	if url := list.url(list.HelpURL, config.HelpURL); url != "" {
+		msg.ListHelp = fmt.Sprintf("<%s>, %s", url, msg.ListHelp)
+	}
+	msg.ListArchive = ""
+	if url := list.url(list.ArchiveURL, config.ArchiveURL); url != "" {
+		msg.ListArchive = fmt.Sprintf("<%s>", url)
+	}
+	msg.ListOwner = ""
+	if url := list.url(list.OwnerURL, config.OwnerURL); url != "" {
+		msg.ListOwner = fmt.Sprintf("<%s>", url)
+	}
+	msg.XMailingList = listAddress
+	// Keep the X-Loop headers of previous hops, to be able to count them
+	msg.XLoop = append([]string{listAddress}, msg.XLoop...)
+}
+
+// received returns the message as it was received, or serialized if it was not parsed
+func (msg *Message) received() []byte {
+	if msg.raw != nil {
+		return msg.raw
+	}
+	return []byte(msg.String())
+}
+
 // String representing the message
 func (msg *Message) String() string {
 	var buf bytes.Buffer
+	msg.WriteTo(&buf)
+	return buf.String()
+}
+
+// WriteTo writes the message to w
+func (msg *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(msg.renderHeader())
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(msg.Body)
+	if err != nil {
+		return int64(n + m), err
+	}
+	t, err := w.Write(msg.trailer)
+	return int64(n + m + t), err
+}
+
+// renderHeader renders the header of the message, including the empty line that ends it
+func (msg *Message) renderHeader() []byte {
+	var buf bytes.Buffer
 
 	if len(msg.XOriginalTo) > 0 {
-		fmt.Fprintf(&buf, "X-Original-To: %s\r\n", msg.XOriginalTo)
+		buf.WriteString(formatHeader("X-Original-To", msg.XOriginalTo))
 	}
-	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
-	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	buf.WriteString(formatHeader("From", msg.From))
+	buf.WriteString(formatHeader("To", msg.To))
 	if len(msg.Cc) > 0 {
-		fmt.Fprintf(&buf, "Cc: %s\r\n", msg.Cc)
+		buf.WriteString(formatHeader("Cc", msg.Cc))
 	}
 	if len(msg.Bcc) > 0 {
-		fmt.Fprintf(&buf, "Bcc: %s\r\n", msg.Bcc)
+		buf.WriteString(formatHeader("Bcc", msg.Bcc))
+	}
+	if len(msg.ReplyTo) > 0 {
+		buf.WriteString(formatHeader("Reply-To", msg.ReplyTo))
 	}
 	if len(msg.Date) > 0 {
-		fmt.Fprintf(&buf, "Date: %s\r\n", msg.Date)
+		buf.WriteString(formatHeader("Date", msg.Date))
 	}
 	if len(msg.Sender) > 0 {
-		fmt.Fprintf(&buf, "Sender: %s\r\n", msg.Sender)
+		buf.WriteString(formatHeader("Sender", msg.Sender))
 	}
 	if len(msg.Address) > 0 {
-		fmt.Fprintf(&buf, "Message-Id: %s\r\n", msg.Address)
+		buf.WriteString(formatHeader("Message-Id", msg.Address))
 	}
 	if len(msg.InReplyTo) > 0 {
-		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", msg.InReplyTo)
+		buf.WriteString(formatHeader("In-Reply-To", msg.InReplyTo))
 	}
 	if len(msg.Precedence) > 0 {
-		fmt.Fprintf(&buf, "Precedence: %s\r\n", msg.Precedence)
+		buf.WriteString(formatHeader("Precedence", msg.Precedence))
+	}
+	if len(msg.AutoSubmitted) > 0 {
+		buf.WriteString(formatHeader("Auto-Submitted", msg.AutoSubmitted))
 	}
 	if len(msg.ListID) > 0 {
-		fmt.Fprintf(&buf, "List-Id: %s\r\n", msg.ListID)
+		buf.WriteString(formatHeader("List-Id", msg.ListID))
 	}
 	if len(msg.ListUnsubscribe) > 0 {
-		fmt.Fprintf(&buf, "List-Unsubscribe: %s\r\n", msg.ListUnsubscribe)
+		buf.WriteString(formatHeader("List-Unsubscribe", msg.ListUnsubscribe))
+	}
+	if len(msg.ListUnsubscribePost) > 0 {
+		buf.WriteString(formatHeader("List-Unsubscribe-Post", msg.ListUnsubscribePost))
 	}
 	if len(msg.ListSubscribe) > 0 {
-		fmt.Fprintf(&buf, "List-Subscribe: %s\r\n", msg.ListSubscribe)
+		buf.WriteString(formatHeader("List-Subscribe", msg.ListSubscribe))
+	}
+	if len(msg.ListPost) > 0 {
+		buf.WriteString(formatHeader("List-Post", msg.ListPost))
 	}
 	if len(msg.ListOwner) > 0 {
-		fmt.Fprintf(&buf, "List-Owner: %s\r\n", msg.ListOwner)
+		buf.WriteString(formatHeader("List-Owner", msg.ListOwner))
 	}
 	if len(msg.ListArchive) > 0 {
-		fmt.Fprintf(&buf, "List-Archive: %s\r\n", msg.ListArchive)
+		buf.WriteString(formatHeader("List-Archive", msg.ListArchive))
 	}
 	if len(msg.ListHelp) > 0 {
-		fmt.Fprintf(&buf, "List-Help: %s\r\n", msg.ListHelp)
+		buf.WriteString(formatHeader("List-Help", msg.ListHelp))
 	}
 	if len(msg.XMailingList) > 0 {
-		fmt.Fprintf(&buf, "X-Mailing-List: %s\r\n", msg.XMailingList)
+		buf.WriteString(formatHeader("X-Mailing-List", msg.XMailingList))
 	}
-	if len(msg.XLoop) > 0 {
-		fmt.Fprintf(&buf, "X-Loop: %s\r\n", msg.XLoop)
+	for _, xLoop := range msg.XLoop {
+		buf.WriteString(formatHeader("X-Loop", xLoop))
 	}
 
-	extraKeys := []string{}
-	for key := range msg.Headers {
-		extraKeys = append(extraKeys, key)
-	}
-	sort.Strings(extraKeys)
-	for _, key := range extraKeys {
-		for _, value := range msg.Headers[key] {
-			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
-		}
-	}
+	buf.WriteString(msg.Headers.String())
 	if len(msg.MIMEVersion) > 0 {
-		fmt.Fprintf(&buf, "MIME-Version: %s\r\n", msg.MIMEVersion)
+		buf.WriteString(formatHeader("MIME-Version", msg.MIMEVersion))
 	}
 	if len(msg.ContentType) > 0 {
-		fmt.Fprintf(&buf, "Content-Type: %s\r\n", msg.ContentType)
+		buf.WriteString(formatHeader("Content-Type", msg.ContentType))
 	}
-	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	buf.WriteString(formatHeader("Subject", msg.Subject))
 	fmt.Fprintf(&buf, "\r\n")
 
-	buf.Write(msg.Body)
+	return buf.Bytes()
+}
 
-	return buf.String()
+// SendVERP sends a Message using an VARP. If personalize is not nil, it is used to obtain the copy of the message for each recipient.
+// The copies are delivered concurrently, as configured by delivery_workers, delivery_rate and domain_rate.
+func (msg *Message) SendVERP(envelopeSender string, recipients []string, personalize func(string) *Message, config Config) error {
+	results := msg.sendVERP(envelopeSender, recipients, personalize, config)
+
+	// The error can end up with the poster, so the recipients and the replies
+	// of the server, which may mention them, are only logged
+	failed := 0
+	for i, err := range results {
+		if err != nil {
+			log.Printf("DELIVERY_FAILED Id=%q To=%q Error=%s\n", msg.Address, recipients[i], err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deliveries failed", failed, len(recipients))
+	}
+	return nil
 }
 
-// SendVERP sends a Message using an VARP
-func (msg *Message) SendVERP(envelopeSender string, recipients []string, SMTPHostname string, SMTPPort uint64, SMTPUsername string, SMTPPassword string, debug bool) error {
+// sendVERP is SendVERP, but returns the result of the delivery to each recipient
+func (msg *Message) sendVERP(envelopeSender string, recipients []string, personalize func(string) *Message, config Config) []error {
+	failAll := func(err error) []error {
+		results := make([]error, len(recipients))
+		for i := range results {
+			results[i] = err
+		}
+		return results
+	}
+
 	parts := strings.SplitN(envelopeSender, "@", 2)
 	if len(parts) < 2 {
-		return fmt.Errorf("invalid envelope sender %s", envelopeSender)
+		return failAll(fmt.Errorf("invalid envelope sender %s", envelopeSender))
 	}
 
-	errors := []error{}
-	for _, recipient := range recipients {
-		envelope := fmt.Sprintf("%s+%s@%s", parts[0], strings.Replace(recipient, "@", "=", 1), parts[1])
-		err := msg.Send(envelope, []string{recipient}, SMTPHostname, SMTPPort, SMTPUsername, SMTPPassword, debug)
+	// Without personalization, every recipient gets the same data
+	var header []byte
+	if personalize == nil {
+		var err error
+		header, err = msg.prepare(config)
 		if err != nil {
-			errors = append(errors, err)
+			return failAll(err)
 		}
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("%d errors occurred: %v", len(errors), errors)
-	}
-	return nil
+	// Deliver the copies concurrently, each worker over its own connection
+	return deliverAll(recipients, func(session *smtpSession, recipient string) error {
+		// Use A-labels, so the envelope sender only needs SMTPUTF8 if the local part of the recipient does
+		verp, _ := asciiAddress(recipient)
+		envelope := fmt.Sprintf("%s+%s@%s", parts[0], strings.Replace(verp, "@", "=", 1), parts[1])
+
+		if personalize == nil {
+			return deliver(session, envelope, []string{recipient}, header, msg.Body, msg.trailer, config)
+		}
+		return personalize(recipient).send(session, envelope, []string{recipient}, config)
+	}, config)
 }
 
 // Send a Message
-func (msg *Message) Send(envelopeSender string, recipients []string, SMTPHostname string, SMTPPort uint64, SMTPUsername string, SMTPPassword string, debug bool) error {
-	if debug {
-		log.Print(msg.SendDebug(envelopeSender, recipients))
+func (msg *Message) Send(envelopeSender string, recipients []string, config Config) error {
+	session := config.smtpSession()
+	defer session.Close()
+	return msg.send(session, envelopeSender, recipients, config)
+}
+
+// send sends a Message over an SMTP session
+func (msg *Message) send(session *smtpSession, envelopeSender string, recipients []string, config Config) error {
+	header, err := msg.prepare(config)
+	if err != nil {
+		return err
+	}
+	return deliver(session, envelopeSender, recipients, header, msg.Body, msg.trailer, config)
+}
+
+// prepare renders the header of a message to send, with its DKIM signature and ARC set.
+// The body is not copied, it is hashed in place.
+func (msg *Message) prepare(config Config) ([]byte, error) {
+	header := msg.renderHeader()
+	if config.DKIMKey == "" {
+		return header, nil
+	}
+
+	bodyHash := msg.relaxedBodyHash()
+	header, err := config.sign(header, bodyHash)
+	if err != nil {
+		return nil, err
+	}
+	if msg.arc != nil {
+		header, err = config.seal(header, bodyHash, msg.arc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// relaxedBodyHash returns the body hash of the DKIM and ARC signatures, of the body
+// followed by the trailer. The body is hashed once, and the hash is kept for the
+// copies of the message that share it.
+func (msg *Message) relaxedBodyHash() string {
+	if msg.bodyHash == nil || !msg.bodyHash.of(msg.Body) {
+		msg.bodyHash = newBodyHash(msg.Body)
+	}
+	return msg.bodyHash.sum(msg.trailer)
+}
+
+// deliver sends a prepared header, a body and a trailer, streaming them to the SMTP server
+func deliver(session *smtpSession, envelopeSender string, recipients []string, header []byte, body []byte, trailer []byte, config Config) error {
+	if config.Debug {
+		data := append(append([]byte{}, header...), body...)
+		log.Print(sendDebug(envelopeSender, recipients, append(data, trailer...)))
 		return nil
 	}
+	return session.Send(envelopeSender, recipients, io.MultiReader(bytes.NewReader(header), bytes.NewReader(body), bytes.NewReader(trailer)))
+}
+
+// smtpSession returns a session with the configured SMTP server. It connects when the first message is sent.
+func (config Config) smtpSession() *smtpSession {
 	var auth smtp.Auth
-	if SMTPUsername != "" {
-		auth = smtp.PlainAuth("", SMTPUsername, SMTPPassword, SMTPHostname)
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHostname)
 	}
-	return SendMail(fmt.Sprintf("%s:%d", SMTPHostname, SMTPPort), auth, envelopeSender, recipients, []byte(msg.String()))
+	return newSMTPSession(fmt.Sprintf("%s:%d", config.SMTPHostname, config.SMTPPort), auth)
 }
 
 // SendDebug returns a string describing the message that would be sent, and its recipients
 func (msg *Message) SendDebug(envelopeSender string, recipients []string) string {
+	return sendDebug(envelopeSender, recipients, []byte(msg.String()))
+}
+
+func sendDebug(envelopeSender string, recipients []string, data []byte) string {
 	out := fmt.Sprintf("------------------------------------------------------------\nSENDING MESSAGE FROM %s TO:\n", envelopeSender)
 	for _, r := range recipients {
 		out = out + fmt.Sprintf(" - %s\n", r)
 	}
-	out += fmt.Sprintf("MESSAGE:\n%s\n", msg.String())
+	out += fmt.Sprintf("MESSAGE:\n%s\n", data)
 	return out
 }
@@ -0,0 +1,152 @@
+package list
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// benchmarkMessage returns a message with a text body of about size bytes
+func benchmarkMessage(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: Bob <bob@example.org>\r\nTo: Foo <foo@example.com>\r\nSubject: Benchmark\r\n" +
+		"Date: Sat, 17 Oct 2026 10:00:00 +0000\r\nMessage-Id: <bench@example.org>\r\n\r\n")
+	line := "All work and no play makes Jack a dull boy.\r\n"
+	for buf.Len() < size {
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkConfig returns a configuration that signs with a new Ed25519 key
+func benchmarkConfig(b *testing.B) Config {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "dkim")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	f.Close()
+	b.Cleanup(func() { os.Remove(f.Name()) })
+
+	return Config{
+		CommandAddress: "tinylist@example.com",
+		DKIMSelector:   "bench",
+		DKIMKey:        f.Name(),
+	}
+}
+
+var benchmarkSizes = []int{1 << 10, 1 << 20}
+
+func BenchmarkFromReader(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		data := benchmarkMessage(size)
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				msg := &Message{}
+				if err := msg.FromReader(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPrepareCopy prepares the copy of a post for a single recipient. The
+// body is neither copied nor hashed again, so the cost does not grow with its size,
+// also not when each copy gets its own footer.
+func BenchmarkPrepareCopy(b *testing.B) {
+	config := benchmarkConfig(b)
+
+	for _, footer := range []string{"", DefaultFooter} {
+		l := &list{Definition: Definition{Address: "foo@example.com", Name: "Foo", Footer: footer}}
+		for _, size := range benchmarkSizes {
+			msg := &Message{}
+			if err := msg.parse(benchmarkMessage(size)); err != nil {
+				b.Fatal(err)
+			}
+			personalize := l.personalizer(msg.ResendAs(l, config), config)
+
+			name := fmt.Sprintf("%dKiB", size>>10)
+			if footer != "" {
+				name += "/footer"
+			}
+			b.Run(name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := personalize(fmt.Sprintf("member%d@example.net", i)).prepare(config); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRelaxedBodyHashCopies(t *testing.T) {
+	msg := &Message{}
+	if err := msg.parse(benchmarkMessage(1 << 10)); err != nil {
+		t.Fatal(err)
+	}
+	hash := msg.relaxedBodyHash()
+
+	// Copies sharing the body share the hash, a changed body is hashed again
+	shared := *msg
+	if shared.relaxedBodyHash() != hash || hash != relaxedBodyHash(msg.Body) {
+		t.Errorf("the hash of a shared body differs")
+	}
+
+	changed := *msg
+	changed.Body = append(append([]byte{}, msg.Body...), "PS\r\n"...)
+	if changed.relaxedBodyHash() != relaxedBodyHash(changed.Body) || changed.relaxedBodyHash() == hash {
+		t.Errorf("the hash of a changed body is not recomputed")
+	}
+
+	copied := *msg
+	copied.Body = append([]byte{}, msg.Body...)
+	if copied.relaxedBodyHash() != hash {
+		t.Errorf("the hash of an equal body differs")
+	}
+
+	// The hash continues with the trailer, after the empty lines that end the body
+	for _, trailer := range []string{"PS\r\n", "\r\n\r\n", "\r\nPS  \t\r\n\r\n"} {
+		withEmpty := *msg
+		withEmpty.Body = append(append([]byte{}, msg.Body...), "\r\n\r\n"...)
+		withEmpty.relaxedBodyHash()
+		withTrailer := withEmpty
+		withTrailer.trailer = []byte(trailer)
+		if withTrailer.relaxedBodyHash() != relaxedBodyHash(append(append([]byte{}, withEmpty.Body...), trailer...)) {
+			t.Errorf("the hash of a body with trailer %q differs", trailer)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	defer func(size int64) { spoolSize = size }(spoolSize)
+	spoolSize = 1 << 10
+
+	for _, size := range []int{1 << 9, 1 << 12} {
+		data := benchmarkMessage(size)
+		spooled, release, err := spool(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(spooled, data) {
+			t.Errorf("spooling %d bytes changed the data", len(data))
+		}
+		release()
+	}
+}
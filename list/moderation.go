@@ -0,0 +1,154 @@
+package list
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// hold stores a message for moderation and notifies the moderators of the list.
+// The message is stored as it was received, so its signatures can be validated on approval.
+func (b *bot) hold(list *list, sender string, msg *Message) error {
+	data := msg.received()
+	expires := time.Now().Add(HoldInterval)
+	token := signToken(b.Secret, expires, "moderate", list.Address, fmt.Sprintf("%x", sha256.Sum256(data)))
+
+	err := list.Hold(HeldMessage{
+		List:    list.Address,
+		Token:   token,
+		Sender:  sender,
+		Subject: msg.Subject,
+		Expires: expires,
+		Message: data,
+		Results: msg.auth.results(),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("MESSAGE_HELD listAddress=%q Id=%q From=%q Subject=%q\n", list.Address, msg.Address, msg.From, msg.Subject)
+
+	message := fmt.Sprintf("A message from %s to the mailing list %s <%s> requires approval.\n\n"+
+		"Subject: %s\nSize: %d bytes\n\n"+
+		"To approve the message, send a message to %s with the following subject:\n\n    approve %s\n\n"+
+		"To reject the message, send a message to %s with the following subject, optionally followed by a reason:\n\n    reject %s\n\n"+
+		"The message expires on %s.",
+		msg.From, list.Name, list.Address, msg.Subject, len(data), b.CommandAddress, token, b.CommandAddress, token, expires.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+
+	for _, moderator := range b.moderators(list) {
+		err = b.notify(moderator, fmt.Sprintf("Approval required for %s: %s", list.Address, msg.Subject), message)
+		if err != nil {
+			log.Printf("NOTIFICATION_FAILED To=%q listAddress=%q Error=%s\n", moderator, list.Address, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// moderators returns the addresses that are notified of held messages of a list
+func (b *bot) moderators(list *list) []string {
+	return append(append([]string{}, b.owners(list)...), list.Moderators...)
+}
+
+// lookupHeld returns a held message and its list, after checking the token
+func (b *bot) lookupHeld(token string) (*HeldMessage, *list, error) {
+	held, err := b.LookupHeld(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if held == nil {
+		return nil, nil, fmt.Errorf("Unable to moderate %s - it is not a valid moderation token", token)
+	}
+
+	err = verifyToken(b.Secret, token, "moderate", held.List, fmt.Sprintf("%x", sha256.Sum256(held.Message)))
+	if err != nil {
+		if deleteErr := b.DeleteHeld(token); deleteErr != nil {
+			return nil, nil, deleteErr
+		}
+		return nil, nil, fmt.Errorf("Unable to moderate message to %s: %s", held.List, err.Error())
+	}
+
+	list, err := b.LookupList(held.List)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if list == nil {
+		return nil, nil, fmt.Errorf("Unable to moderate message to %s - it is not a valid mailing list", held.List)
+	}
+
+	return held, list, nil
+}
+
+// Approve a held message, sending it to the list
+func (b *bot) Approve(token string) (*list, *HeldMessage, error) {
+	held, list, err := b.lookupHeld(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := &Message{}
+	err = msg.parse(held.Message)
+	if err != nil {
+		return list, held, err
+	}
+	// SPF can't be checked again without the envelope, and DKIM keys may have been rotated since
+	msg.auth = &authentication{recorded: held.Results}
+
+	// Remove the message first, so it is never sent twice
+	err = b.DeleteHeld(token)
+	if err != nil {
+		return list, held, err
+	}
+
+	log.Printf("MESSAGE_APPROVED listAddress=%q Id=%q From=%q Subject=%q\n", list.Address, msg.Address, msg.From, msg.Subject)
+
+	return list, held, b.post(list, msg)
+}
+
+// Reject a held message, notifying the poster
+func (b *bot) Reject(token string, reason string) (*list, *HeldMessage, error) {
+	held, list, err := b.lookupHeld(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = b.DeleteHeld(token)
+	if err != nil {
+		return list, held, err
+	}
+
+	log.Printf("MESSAGE_REJECTED listAddress=%q From=%q Subject=%q Reason=%q\n", list.Address, held.Sender, held.Subject, reason)
+
+	message := fmt.Sprintf("Your message to %s with subject %q was rejected by a moderator.", list.Address, held.Subject)
+	if reason != "" {
+		message += fmt.Sprintf("\n\nReason: %s", reason)
+	}
+
+	// The sender of a held message is easily forged, so the rejection is subject to the same limits as any reply
+	suppressed := "invalid message"
+	msg := &Message{}
+	if msg.parse(held.Message) == nil {
+		suppressed = b.suppressReply(msg)
+	}
+	if suppressed != "" {
+		log.Printf("REPLY_SUPPRESSED To=%q Subject=%q Reason=%q Message=%s\n", held.Sender, held.Subject, suppressed, strings.Replace(message, "\n", " ", -1))
+		return list, held, nil
+	}
+
+	err = b.notify(held.Sender, fmt.Sprintf("Your message to %s was rejected", list.Address), message)
+	if err != nil {
+		log.Printf("NOTIFICATION_FAILED To=%q listAddress=%q Error=%s\n", held.Sender, list.Address, err.Error())
+		return list, held, nil
+	}
+
+	err = b.AddReply(canonicalAddress(held.Sender), time.Now())
+	if err != nil {
+		log.Printf("REPLY_COUNT_FAILED To=%q Error=%s\n", held.Sender, err.Error())
+	}
+
+	return list, held, nil
+}
@@ -0,0 +1,336 @@
+package list
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// QueueStatus is the status of a queued delivery
+type QueueStatus string
+
+// Queue statuses
+const (
+	// QueuePending deliveries are retried when their next attempt is due
+	QueuePending QueueStatus = "pending"
+	// QueueFailed deliveries failed permanently, they are kept for inspection
+	QueueFailed QueueStatus = "failed"
+)
+
+// QueueLifetime is the time after which pending deliveries are given up
+const QueueLifetime = 5 * 24 * time.Hour
+
+// QueueRetention is the time after which failed deliveries are removed from the queue
+const QueueRetention = 7 * 24 * time.Hour
+
+// QueuedMessage describes a message in the outbound queue, with the deliveries that failed
+type QueuedMessage struct {
+	ID      string
+	List    string
+	Sender  string
+	Subject string
+	Created time.Time
+	// ARCInstance, ARCResults and ARCChainValidation hold the ARC set to add, if ARCInstance is not zero
+	ARCInstance        int
+	ARCResults         string
+	ARCChainValidation string
+	Message            []byte
+	Deliveries         []QueuedDelivery
+}
+
+// QueuedDelivery describes the delivery of a queued message to a single recipient
+type QueuedDelivery struct {
+	Recipient   string
+	Status      QueueStatus
+	Attempts    int
+	NextAttempt time.Time
+	Error       string
+}
+
+// String representing the queued message
+func (q QueuedMessage) String() string {
+	out := fmt.Sprintf("%s %s %s\nFrom: %s\nSubject: %s\n", q.ID, q.List, q.Created.Format("2006-01-02 15:04:05"), q.Sender, q.Subject)
+	for _, d := range q.Deliveries {
+		switch d.Status {
+		case QueuePending:
+			out += fmt.Sprintf(" - %s pending, %d attempts, next at %s: %s\n", d.Recipient, d.Attempts, d.NextAttempt.Format("2006-01-02 15:04:05"), d.Error)
+		default:
+			out += fmt.Sprintf(" - %s %s after %d attempts: %s\n", d.Recipient, d.Status, d.Attempts, d.Error)
+		}
+	}
+	return out
+}
+
+// queueBackoff returns the time between a failed attempt and the next one,
+// doubling from 5 minutes up to 4 hours
+func queueBackoff(attempts int) time.Duration {
+	backoff := 5 * time.Minute
+	for i := 1; i < attempts && backoff < 4*time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > 4*time.Hour {
+		backoff = 4 * time.Hour
+	}
+	return backoff
+}
+
+// permanent checks whether a delivery error will not go away by retrying:
+// a 5xx reply of the server, or an address that needs SMTPUTF8 or is malformed
+func permanent(err error) bool {
+	switch err := err.(type) {
+	case *textproto.Error:
+		return err.Code >= 500
+	case *smtpUTF8Error:
+		return true
+	}
+	return err == errLineBreak
+}
+
+// send delivers a message to the recipients, and queues the deliveries that failed.
+// Transient failures are retried by RunQueue, only permanent failures are returned.
+// It returns the number of deliveries that are queued for a retry.
+func (list *list) send(msg *Message, recipients []string, config Config) (int, error) {
+	envelopeSender, err := list.envelopeSender(config)
+	if err != nil {
+		return 0, err
+	}
+
+	results := msg.sendVERP(envelopeSender, recipients, list.personalizer(msg, config), config)
+
+	// The error can end up with the poster, so the recipients and the replies
+	// of the server, which may mention them, are only logged
+	now := time.Now()
+	deliveries := []QueuedDelivery{}
+	failed := 0
+	for i, err := range results {
+		if err == nil {
+			continue
+		}
+
+		delivery := QueuedDelivery{
+			Recipient: recipients[i],
+			Status:    QueuePending,
+			Attempts:  1,
+			Error:     err.Error(),
+		}
+		if permanent(err) {
+			delivery.Status = QueueFailed
+			failed++
+			log.Printf("DELIVERY_FAILED listAddress=%q Id=%q To=%q Attempts=%d Error=%s\n", list.Address, msg.Address, recipients[i], delivery.Attempts, err.Error())
+		} else {
+			delivery.NextAttempt = now.Add(queueBackoff(delivery.Attempts))
+			log.Printf("DELIVERY_DEFERRED listAddress=%q Id=%q To=%q Attempts=%d Error=%s\n", list.Address, msg.Address, recipients[i], delivery.Attempts, err.Error())
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+
+	err = list.enqueue(msg, deliveries, now)
+	if err != nil {
+		// Without the queue, every failed delivery is lost
+		log.Printf("ENQUEUE_FAILED listAddress=%q Id=%q Error=%s\n", list.Address, msg.Address, err.Error())
+		return 0, fmt.Errorf("%d of %d deliveries failed", len(deliveries), len(recipients))
+	}
+
+	if failed > 0 {
+		return len(deliveries) - failed, fmt.Errorf("%d of %d deliveries failed", failed, len(recipients))
+	}
+	return len(deliveries), nil
+}
+
+// enqueue stores the failed deliveries of a message in the outbound queue
+func (list *list) enqueue(msg *Message, deliveries []QueuedDelivery, now time.Time) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+
+	queued := QueuedMessage{
+		ID:         hex.EncodeToString(random),
+		List:       list.Address,
+		Sender:     msg.From,
+		Subject:    msg.Subject,
+		Created:    now,
+		Message:    []byte(msg.String()),
+		Deliveries: deliveries,
+	}
+	if msg.arc != nil {
+		queued.ARCInstance = msg.arc.Instance
+		queued.ARCResults = msg.arc.Results
+		queued.ARCChainValidation = msg.arc.ChainValidation
+	}
+
+	err := list.Enqueue(queued)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("MESSAGE_QUEUED listAddress=%q Id=%q QueueId=%q Recipients=%d\n", list.Address, msg.Address, queued.ID, len(deliveries))
+	return nil
+}
+
+// wants checks whether an address still receives the posts of a list: it is
+// subscribed and not in nomail mode, or it is a bcc address of the list
+func (list *list) wants(address string) (bool, error) {
+	for _, bcc := range list.Bcc {
+		if strings.EqualFold(bcc, address) {
+			return true, nil
+		}
+	}
+
+	subscription, err := list.IsSubscribed(address)
+	if err != nil {
+		return false, err
+	}
+	return subscription != nil && subscription.Mode != ModeNoMail, nil
+}
+
+// RunQueue retries the queued deliveries that are due, or all pending deliveries
+// if force is set, and removes the failed deliveries that are past retention
+func (b *bot) RunQueue(force bool) error {
+	now := time.Now()
+
+	err := b.PurgeQueue(now.Add(-QueueRetention))
+	if err != nil {
+		return err
+	}
+
+	messages, err := b.Queued()
+	if err != nil {
+		return err
+	}
+
+	// Go through all messages - don't stop at the first error!
+	errors := map[string]error{}
+	for _, queued := range messages {
+		err := b.retry(queued, now, force)
+		if err != nil {
+			log.Printf("QUEUE_FAILED QueueId=%q listAddress=%q Error=%s\n", queued.ID, queued.List, err.Error())
+
+			errors[queued.ID] = err
+		}
+	}
+
+	if len(errors) > 0 {
+		strs := []string{}
+		for id, err := range errors {
+			strs = append(strs, fmt.Sprintf("%s: %s", id, err.Error()))
+		}
+		return fmt.Errorf("%d queued messages failed: %s", len(errors), strings.Join(strs, ", "))
+	}
+
+	return nil
+}
+
+// retry retries the due deliveries of a queued message
+func (b *bot) retry(queued QueuedMessage, now time.Time, force bool) error {
+	due := []QueuedDelivery{}
+	for _, delivery := range queued.Deliveries {
+		if delivery.Status == QueuePending && (force || !delivery.NextAttempt.After(now)) {
+			due = append(due, delivery)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	list, err := b.LookupList(queued.List)
+	if err != nil {
+		return err
+	}
+
+	// Don't retry deliveries to addresses that unsubscribed in the meantime
+	if list != nil {
+		wanted := []QueuedDelivery{}
+		for _, delivery := range due {
+			ok, err := list.wants(delivery.Recipient)
+			if err != nil {
+				return err
+			}
+			if ok {
+				wanted = append(wanted, delivery)
+				continue
+			}
+
+			log.Printf("DELIVERY_DROPPED QueueId=%q listAddress=%q To=%q Attempts=%d\n", queued.ID, queued.List, delivery.Recipient, delivery.Attempts)
+
+			err = b.DeleteQueued(queued.ID, delivery.Recipient)
+			if err != nil {
+				return err
+			}
+		}
+		due = wanted
+		if len(due) == 0 {
+			return nil
+		}
+	}
+
+	var results []error
+	if list == nil {
+		results = make([]error, len(due))
+		for i := range results {
+			results[i] = fmt.Errorf("Unable to send to %s - list no longer exists", queued.List)
+		}
+	} else {
+		msg := &Message{}
+		err = msg.parse(queued.Message)
+		if err != nil {
+			return err
+		}
+		if queued.ARCInstance > 0 {
+			msg.arc = &arcSet{
+				Instance:        queued.ARCInstance,
+				Results:         queued.ARCResults,
+				ChainValidation: queued.ARCChainValidation,
+			}
+		}
+
+		config := list.sendConfig(b.Config)
+		envelopeSender, err := list.envelopeSender(config)
+		if err != nil {
+			return err
+		}
+
+		recipients := []string{}
+		for _, delivery := range due {
+			recipients = append(recipients, delivery.Recipient)
+		}
+		results = msg.sendVERP(envelopeSender, recipients, list.personalizer(msg, config), config)
+	}
+
+	for i, delivery := range due {
+		if results[i] == nil {
+			log.Printf("DELIVERY_SENT QueueId=%q listAddress=%q To=%q Attempts=%d\n", queued.ID, queued.List, delivery.Recipient, delivery.Attempts+1)
+
+			err = b.DeleteQueued(queued.ID, delivery.Recipient)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.Error = results[i].Error()
+		if list == nil || permanent(results[i]) || now.Sub(queued.Created) > QueueLifetime {
+			delivery.Status = QueueFailed
+			log.Printf("DELIVERY_FAILED QueueId=%q listAddress=%q To=%q Attempts=%d Error=%s\n", queued.ID, queued.List, delivery.Recipient, delivery.Attempts, delivery.Error)
+		} else {
+			delivery.NextAttempt = now.Add(queueBackoff(delivery.Attempts))
+			log.Printf("DELIVERY_DEFERRED QueueId=%q listAddress=%q To=%q Attempts=%d Error=%s\n", queued.ID, queued.List, delivery.Recipient, delivery.Attempts, delivery.Error)
+		}
+
+		err = b.UpdateQueued(queued.ID, delivery)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{0, 5 * time.Minute},
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{3, 20 * time.Minute},
+		{6, 160 * time.Minute},
+		{7, 4 * time.Hour},
+		{100, 4 * time.Hour},
+	}
+
+	for _, test := range tests {
+		if backoff := queueBackoff(test.attempts); backoff != test.backoff {
+			t.Errorf("queueBackoff(%d) = %s, want %s", test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "Service not available"}, false},
+		{&textproto.Error{Code: 451, Msg: "Try again later"}, false},
+		{&textproto.Error{Code: 550, Msg: "No such user"}, true},
+		{&textproto.Error{Code: 554, Msg: "Transaction failed"}, true},
+		{&smtpUTF8Error{"recipients", []string{"jörg@example.com"}}, true},
+		{errLineBreak, true},
+		{errors.New("dial tcp: connection refused"), false},
+	}
+
+	for _, test := range tests {
+		if permanent(test.err) != test.permanent {
+			t.Errorf("permanent(%q) = %t", test.err.Error(), !test.permanent)
+		}
+	}
+}
+
+// queueTestConfig returns a configuration that delivers to the fake SMTP server
+func queueTestConfig(t *testing.T, server *fakeSMTPServer) Config {
+	host, port, err := net.SplitHostPort(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpPort, _ := strconv.ParseUint(port, 10, 64)
+
+	return Config{
+		CommandAddress: "tinylist@example.com",
+		BouncesAddress: "bounces@example.com",
+		SMTPHostname:   host,
+		SMTPPort:       smtpPort,
+	}
+}
+
+func TestSendQueuesFailures(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	definition := Definition{Address: "foo@example.com", Name: "Foo"}
+	backend := newMemoryBackend(queueTestConfig(t, server), definition)
+	l := NewList(backend, definition)
+
+	msg := &Message{From: "bob@example.org", Subject: "Test", Address: "<test@example.org>", Body: []byte("Hello\r\n")}
+	queued, err := l.send(msg, []string{"bob@example.com", "reject@example.com", "defer@example.com"}, backend.config)
+	if err == nil || queued != 1 {
+		t.Errorf("got %d queued deliveries and error %v, want 1 and an error", queued, err)
+	}
+
+	if len(backend.queue) != 1 {
+		t.Fatalf("%d queued messages, want 1", len(backend.queue))
+	}
+	deliveries := backend.queue[0].Deliveries
+	if len(deliveries) != 2 {
+		t.Fatalf("%d queued deliveries, want 2", len(deliveries))
+	}
+	for _, d := range deliveries {
+		switch d.Recipient {
+		case "reject@example.com":
+			if d.Status != QueueFailed {
+				t.Errorf("a refused recipient is %s", d.Status)
+			}
+		case "defer@example.com":
+			if d.Status != QueuePending || d.Attempts != 1 || time.Until(d.NextAttempt) > queueBackoff(1) || time.Until(d.NextAttempt) < queueBackoff(1)-time.Minute {
+				t.Errorf("a deferred recipient is %s after %d attempts, next at %s", d.Status, d.Attempts, d.NextAttempt)
+			}
+		default:
+			t.Errorf("%s is queued", d.Recipient)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	definition := Definition{Address: "foo@example.com", Name: "Foo", Bcc: []string{"archive@example.net"}}
+	backend := newMemoryBackend(queueTestConfig(t, server), definition)
+	backend.subscriptions[definition.Address] = []Subscription{
+		{Address: "bob@example.com", Mode: ModeRegular},
+		{Address: "carol@example.com", Mode: ModeNoMail},
+		{Address: "defer-recent@example.com", Mode: ModeRegular},
+		{Address: "defer-expired@example.com", Mode: ModeRegular},
+	}
+
+	now := time.Now()
+	pending := func(recipient string) QueuedDelivery {
+		return QueuedDelivery{Recipient: recipient, Status: QueuePending, Attempts: 1, NextAttempt: now.Add(-time.Minute)}
+	}
+	message := []byte("From: bob@example.org\r\nSubject: Test\r\nMessage-Id: <test@example.org>\r\n\r\nHello\r\n")
+	backend.queue = []QueuedMessage{
+		{
+			ID:      "recent",
+			List:    definition.Address,
+			Created: now.Add(-time.Hour),
+			Message: message,
+			Deliveries: []QueuedDelivery{
+				pending("bob@example.com"),
+				pending("carol@example.com"),
+				pending("dave@example.com"),
+				pending("archive@example.net"),
+				pending("defer-recent@example.com"),
+			},
+		},
+		{
+			ID:         "expired",
+			List:       definition.Address,
+			Created:    now.Add(-QueueLifetime - time.Hour),
+			Message:    message,
+			Deliveries: []QueuedDelivery{pending("defer-expired@example.com")},
+		},
+	}
+
+	err := NewBot(backend).RunQueue(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivered, unsubscribed and nomail recipients are removed from the queue
+	remaining := map[string]QueuedDelivery{}
+	for _, q := range backend.queue {
+		for _, d := range q.Deliveries {
+			remaining[d.Recipient] = d
+		}
+	}
+	if len(remaining) != 2 {
+		t.Errorf("remaining deliveries %v, want those to defer-recent and defer-expired", remaining)
+	}
+	if d := remaining["defer-recent@example.com"]; d.Status != QueuePending || d.Attempts != 2 || !d.NextAttempt.After(now.Add(queueBackoff(1))) {
+		t.Errorf("the recent delivery is %s after %d attempts, next at %s", d.Status, d.Attempts, d.NextAttempt)
+	}
+	if d := remaining["defer-expired@example.com"]; d.Status != QueueFailed {
+		t.Errorf("the expired delivery is %s", d.Status)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	sort.Strings(server.delivered)
+	if fmt.Sprint(server.delivered) != "[archive@example.net bob@example.com]" {
+		t.Errorf("delivered to %v", server.delivered)
+	}
+}
+
+func TestRetryDebug(t *testing.T) {
+	// In debug mode, messages are printed instead of sent
+	definition := Definition{Address: "foo@example.com", Name: "Foo"}
+	backend := newMemoryBackend(Config{Debug: true, BouncesAddress: "bounces@example.com", SMTPHostname: "invalid.", SMTPPort: 25}, definition)
+	backend.subscriptions[definition.Address] = []Subscription{{Address: "bob@example.com", Mode: ModeRegular}}
+	backend.queue = []QueuedMessage{{
+		ID:         "debug",
+		List:       definition.Address,
+		Created:    time.Now(),
+		Message:    []byte("From: bob@example.org\r\nSubject: Test\r\n\r\nHello\r\n"),
+		Deliveries: []QueuedDelivery{{Recipient: "bob@example.com", Status: QueuePending, Attempts: 1}},
+	}}
+
+	err := NewBot(backend).RunQueue(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.queue) != 0 {
+		t.Errorf("the queue is not empty: %v", backend.queue)
+	}
+}
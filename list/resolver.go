@@ -0,0 +1,52 @@
+package list
+
+import (
+	"errors"
+	"net"
+)
+
+// A Resolver looks up DNS records. It returns no records and no error for
+// names that do not exist.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(name string) ([]net.IP, error)
+	LookupMX(name string) ([]string, error)
+}
+
+// netResolver resolves names using the resolver of the system
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	records, err := net.LookupTXT(name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+func (netResolver) LookupIP(name string) ([]net.IP, error) {
+	ips, err := net.LookupIP(name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return ips, err
+}
+
+func (netResolver) LookupMX(name string) ([]string, error) {
+	records, err := net.LookupMX(name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+
+	hosts := []string{}
+	for _, mx := range records {
+		hosts = append(hosts, mx.Host)
+	}
+	return hosts, err
+}
+
+// isNotFound checks whether a DNS error means the name does not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,35 @@
+package list
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// stubResolver answers DNS lookups from fixed records. Names listed in fail
+// return a temporary error, all other unknown names do not exist.
+type stubResolver struct {
+	txt  map[string][]string
+	ip   map[string][]net.IP
+	mx   map[string][]string
+	fail map[string]bool
+}
+
+func (r stubResolver) lookup(name string) error {
+	if r.fail[strings.ToLower(name)] {
+		return errors.New("temporary failure in name resolution")
+	}
+	return nil
+}
+
+func (r stubResolver) LookupTXT(name string) ([]string, error) {
+	return r.txt[strings.ToLower(name)], r.lookup(name)
+}
+
+func (r stubResolver) LookupIP(name string) ([]net.IP, error) {
+	return r.ip[strings.ToLower(name)], r.lookup(name)
+}
+
+func (r stubResolver) LookupMX(name string) ([]string, error) {
+	return r.mx[strings.ToLower(name)], r.lookup(name)
+}
@@ -1,55 +1,163 @@
 package list
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 )
 
 // SendMail with InsecureSkipVerify set to true
 func SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(addr)
+	session := newSMTPSession(addr, a)
+	defer session.Close()
+	return session.Send(from, to, bytes.NewReader(msg))
+}
+
+// An smtpSession sends messages over a single SMTP connection. The connection
+// is opened when the first message is sent, and kept open for the next ones,
+// with RSET between transactions. It is reopened if it broke.
+type smtpSession struct {
+	addr   string
+	auth   smtp.Auth
+	client *smtp.Client
+}
+
+func newSMTPSession(addr string, a smtp.Auth) *smtpSession {
+	return &smtpSession{
+		addr: addr,
+		auth: a,
+	}
+}
+
+// connect opens the connection, and starts TLS and authenticates if possible
+func (s *smtpSession) connect() error {
+	c, err := smtp.Dial(s.addr)
 
 	if err != nil {
 		return err
 	}
 
-	defer c.Close()
-
 	if ok, _ := c.Extension("STARTTLS"); ok {
 		config := &tls.Config{InsecureSkipVerify: true}
 		if err = c.StartTLS(config); err != nil {
+			c.Close()
 			return err
 		}
 	}
 
-	if a != nil {
+	if s.auth != nil {
 		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
 			return errors.New("smtp: server doesn't support AUTH")
 		}
 
-		if err = c.Auth(a); err != nil {
+		if err = c.Auth(s.auth); err != nil {
+			c.Close()
 			return err
 		}
 	}
 
-	if err = c.Mail(from); err != nil {
-		return err
+	s.client = c
+	return nil
+}
+
+// Send sends a message that is streamed from a reader
+func (s *smtpSession) Send(from string, to []string, msg io.Reader) error {
+	// Reset the previous transaction. If that fails, the server probably closed the connection.
+	if s.client != nil {
+		if err := s.client.Reset(); err != nil {
+			s.client.Close()
+			s.client = nil
+		}
 	}
 
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+	if s.client == nil {
+		if err := s.connect(); err != nil {
 			return err
 		}
 	}
 
-	w, err := c.Data()
+	err := s.transaction(from, to, msg)
+
+	// Any other error than a reply of the server or a refused address leaves
+	// the session in an unknown state
+	if err != nil && s.client != nil && !keepsSession(err) {
+		s.client.Close()
+		s.client = nil
+	}
+
+	return err
+}
+
+// errLineBreak is returned for addresses that would break the SMTP commands
+var errLineBreak = errors.New("smtp: A line must not contain CR or LF")
+
+// keepsSession checks whether the connection is still usable after an error of a transaction
+func keepsSession(err error) bool {
+	switch err := err.(type) {
+	case *textproto.Error:
+		// A reply of the server, unless it is closing the connection
+		return err.Code != 421
+	case *smtpUTF8Error:
+		// Addresses refused before they were sent, or after the data was accepted
+		return true
+	}
+	return err == errLineBreak
+}
+
+// transaction sends a message over the open connection
+func (s *smtpSession) transaction(from string, to []string, msg io.Reader) error {
+	c := s.client
+
+	// Internationalized addresses need SMTPUTF8 (RFC 6531), which net/smtp
+	// requests whenever the server supports it
+	smtpUTF8, _ := c.Extension("SMTPUTF8")
+
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return errLineBreak
+		}
+	}
+
+	from, ok := asciiAddress(from)
+	if !ok && !smtpUTF8 {
+		return &smtpUTF8Error{"sender", []string{from}}
+	}
+
+	rcpts := []string{}
+	failed := []string{}
+	for _, addr := range to {
+		rcpt, ok := asciiAddress(addr)
+		if !ok && !smtpUTF8 {
+			failed = append(failed, addr)
+			continue
+		}
+		rcpts = append(rcpts, rcpt)
+	}
+
+	unsupported := &smtpUTF8Error{"recipients", failed}
+	if len(rcpts) == 0 {
+		return unsupported
+	}
+
+	var w io.WriteCloser
+	var err error
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		w, err = s.pipeline(from, rcpts)
+	} else {
+		w, err = s.lockstep(from, rcpts)
+	}
 
 	if err != nil {
 		return err
 	}
 
-	_, err = w.Write(msg)
+	_, err = io.Copy(w, msg)
 
 	if err != nil {
 		return err
@@ -57,9 +165,135 @@ func SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) er
 
 	err = w.Close()
 
+	if err == nil && len(failed) > 0 {
+		return unsupported
+	}
+	return err
+}
+
+// lockstep sends the envelope of a message command by command, and starts the data
+func (s *smtpSession) lockstep(from string, to []string) (io.WriteCloser, error) {
+	c := s.client
+
+	if err := c.Mail(from); err != nil {
+		return nil, err
+	}
+
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.Data()
+}
+
+// pipeline sends the envelope of a message and the start of the data in a single
+// group of commands (RFC 2920), and then reads the replies. The addresses must not
+// contain line breaks.
+func (s *smtpSession) pipeline(from string, to []string) (io.WriteCloser, error) {
+	c := s.client
+
+	// Use the same parameters as net/smtp
+	mail := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		mail += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		mail += " SMTPUTF8"
+	}
+
+	ids := []uint{}
+	id, err := c.Text.Cmd(mail, from)
 	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, id)
+	for _, rcpt := range to {
+		id, err = c.Text.Cmd("RCPT TO:<%s>", rcpt)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	id, err = c.Text.Cmd("DATA")
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, id)
+
+	// Read all replies, keeping the first failure
+	var failure error
+	for i, id := range ids {
+		expectCode := 25
+		switch i {
+		case 0:
+			expectCode = 250
+		case len(ids) - 1:
+			expectCode = 354
+		}
+
+		c.Text.StartResponse(id)
+		_, _, err = c.Text.ReadResponse(expectCode)
+		c.Text.EndResponse(id)
+
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return nil, err
+		}
+		if err != nil && failure == nil {
+			failure = err
+		}
+	}
+
+	if failure == nil {
+		return &dataWriter{c.Text.DotWriter(), c.Text}, nil
+	}
+
+	// If the server accepted the data nevertheless, the transaction can only
+	// be aborted by closing the connection
+	if err == nil {
+		c.Close()
+		s.client = nil
+	}
+	return nil, failure
+}
+
+// An smtpUTF8Error reports the addresses that need SMTPUTF8, if the server does not support it
+type smtpUTF8Error struct {
+	role      string
+	addresses []string
+}
+
+func (e *smtpUTF8Error) Error() string {
+	return fmt.Sprintf("smtp: server doesn't support SMTPUTF8, needed for %s %s", e.role, strings.Join(e.addresses, ", "))
+}
+
+// A dataWriter writes the data of a message, and reads the reply of the server when it is closed
+type dataWriter struct {
+	io.WriteCloser
+	text *textproto.Conn
+}
+
+func (d *dataWriter) Close() error {
+	if err := d.WriteCloser.Close(); err != nil {
 		return err
 	}
+	_, _, err := d.text.ReadResponse(250)
+	return err
+}
+
+// Close ends the session
+func (s *smtpSession) Close() error {
+	if s.client == nil {
+		return nil
+	}
+
+	c := s.client
+	s.client = nil
 
-	return c.Quit()
+	err := c.Quit()
+	if err != nil {
+		c.Close()
+	}
+	return err
 }
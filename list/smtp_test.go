@@ -0,0 +1,126 @@
+package list
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer accepts mail for any recipient, except those starting with "reject"
+// or "defer", and counts the connections. It does not support SMTPUTF8 nor pipelining.
+type fakeSMTPServer struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	connections int
+	delivered   []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.connections++
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+
+	recipients := []string{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			text.PrintfLine("250-localhost\r\n250 8BITMIME")
+		case "MAIL", "RSET":
+			recipients = []string{}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.HasPrefix(line[len("RCPT TO:<"):], "reject") {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+			if strings.HasPrefix(line[len("RCPT TO:<"):], "defer") {
+				text.PrintfLine("451 Try again later")
+				continue
+			}
+			recipients = append(recipients, line[len("RCPT TO:<"):len(line)-1])
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			if _, err := text.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.delivered = append(s.delivered, recipients...)
+			s.mutex.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPSessionKeepsConnection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	session := newSMTPSession(server.listener.Addr().String(), nil)
+	defer session.Close()
+
+	tests := []struct {
+		to  string
+		err bool
+	}{
+		{"bob@example.com", false},
+		// Refused by the server
+		{"reject@example.com", true},
+		// Refused before anything is sent
+		{"jörg@example.com", true},
+		{"eve@example.com\r\nRCPT TO:<mallory@example.com>", true},
+		{"carol@example.com", false},
+	}
+
+	for _, test := range tests {
+		err := session.Send("list@example.com", []string{test.to}, bufio.NewReader(strings.NewReader("Subject: test\r\n\r\nHello\r\n")))
+		if (err != nil) != test.err {
+			t.Errorf("Send to %q: unexpected error %v", test.to, err)
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.connections != 1 {
+		t.Errorf("%d connections opened, want 1", server.connections)
+	}
+	if fmt.Sprint(server.delivered) != "[bob@example.com carol@example.com]" {
+		t.Errorf("delivered to %v", server.delivered)
+	}
+}
@@ -0,0 +1,408 @@
+package list
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// spfLookupLimit is the maximum number of mechanisms and modifiers that cause DNS lookups
+const spfLookupLimit = 10
+
+// spfVoidLimit is the maximum number of DNS lookups that return no records
+const spfVoidLimit = 2
+
+// An spfCheck holds the state of a single check_host() evaluation
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// checkSPF checks whether a client is allowed to send mail for the domain of the sender
+func checkSPF(resolver Resolver, ip net.IP, sender string, helo string) (string, error) {
+	// The null sender is checked as postmaster of the HELO domain
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+
+	c := &spfCheck{
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	return c.checkHost(sender[strings.LastIndex(sender, "@")+1:])
+}
+
+// checkHost evaluates the SPF record of a domain
+func (c *spfCheck) checkHost(domain string) (string, error) {
+	records, err := c.resolver.LookupTXT(domain)
+	if err != nil {
+		return SPFTempError, err
+	}
+
+	record := ""
+	for _, r := range records {
+		if r == "v=spf1" || strings.HasPrefix(strings.ToLower(r), "v=spf1 ") {
+			if record != "" {
+				return SPFPermError, fmt.Errorf("Multiple SPF records for %s", domain)
+			}
+			record = r
+		}
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if strings.HasPrefix(strings.ToLower(term), "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		if strings.Contains(term, "=") && !strings.ContainsAny(term[:strings.Index(term, "=")], ":/") {
+			// Unknown modifiers are ignored
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		match, result, err := c.mechanism(domain, term)
+		if err != nil {
+			return result, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err
+		}
+		if err := c.count(); err != nil {
+			return SPFPermError, err
+		}
+		result, err := c.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError, fmt.Errorf("No SPF record for redirect %s", target)
+		}
+		return result, err
+	}
+
+	return SPFNeutral, nil
+}
+
+// mechanism evaluates a single mechanism, and returns whether it matched. If
+// an error occurs, the result of the whole evaluation is returned as well.
+func (c *spfCheck) mechanism(domain string, term string) (bool, string, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	// Split off the CIDR lengths of a and mx
+	ip4Len, ip6Len := 32, 128
+	if name == "a" || name == "mx" {
+		var err error
+		arg, ip4Len, ip6Len, err = splitCIDR(arg)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+	}
+
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		var err error
+		target, err = c.expand(arg[1:], domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+	}
+
+	switch name {
+	case "all":
+		return true, "", nil
+	case "ip4", "ip6":
+		network := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		return ipNet.Contains(c.ip), "", nil
+	case "a":
+		if err := c.count(); err != nil {
+			return false, SPFPermError, err
+		}
+		match, found, err := c.matchHost(target, ip4Len, ip6Len)
+		if err != nil {
+			return false, SPFTempError, err
+		}
+		if err := c.checkVoids(found); err != nil {
+			return false, SPFPermError, err
+		}
+		return match, "", nil
+	case "mx":
+		if err := c.count(); err != nil {
+			return false, SPFPermError, err
+		}
+		hosts, err := c.resolver.LookupMX(target)
+		if err != nil {
+			return false, SPFTempError, err
+		}
+		if err := c.checkVoids(len(hosts) > 0); err != nil {
+			return false, SPFPermError, err
+		}
+		if len(hosts) > spfLookupLimit {
+			return false, SPFPermError, fmt.Errorf("Too many MX records for %s", target)
+		}
+		for _, host := range hosts {
+			match, _, err := c.matchHost(host, ip4Len, ip6Len)
+			if err != nil {
+				return false, SPFTempError, err
+			}
+			if match {
+				return true, "", nil
+			}
+		}
+		return false, "", nil
+	case "include":
+		if err := c.count(); err != nil {
+			return false, SPFPermError, err
+		}
+		result, err := c.checkHost(target)
+		switch result {
+		case SPFPass:
+			return true, "", nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, "", nil
+		case SPFNone:
+			return false, SPFPermError, fmt.Errorf("No SPF record for include %s", target)
+		default:
+			return false, result, err
+		}
+	case "exists":
+		if err := c.count(); err != nil {
+			return false, SPFPermError, err
+		}
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil {
+			return false, SPFTempError, err
+		}
+		if err := c.checkVoids(len(ips) > 0); err != nil {
+			return false, SPFPermError, err
+		}
+		return len(ips) > 0, "", nil
+	case "ptr":
+		// Deprecated and expensive, never matches
+		if err := c.count(); err != nil {
+			return false, SPFPermError, err
+		}
+		return false, "", nil
+	default:
+		return false, SPFPermError, fmt.Errorf("Unknown SPF mechanism %s", name)
+	}
+}
+
+// matchHost checks whether the client address is one of the addresses of a host,
+// and whether the host has any addresses
+func (c *spfCheck) matchHost(host string, ip4Len int, ip6Len int) (bool, bool, error) {
+	ips, err := c.resolver.LookupIP(host)
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, ip := range ips {
+		mask := net.CIDRMask(ip6Len, 128)
+		if ip.To4() != nil {
+			ip, mask = ip.To4(), net.CIDRMask(ip4Len, 32)
+		}
+		if (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).Contains(c.ip) {
+			return true, true, nil
+		}
+	}
+	return false, len(ips) > 0, nil
+}
+
+// count counts a mechanism or modifier that causes DNS lookups
+func (c *spfCheck) count() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return fmt.Errorf("Too many DNS lookups")
+	}
+	return nil
+}
+
+// checkVoids counts DNS lookups without results
+func (c *spfCheck) checkVoids(found bool) error {
+	if !found {
+		c.voids++
+	}
+	if c.voids > spfVoidLimit {
+		return fmt.Errorf("Too many void DNS lookups")
+	}
+	return nil
+}
+
+// splitCIDR splits the dual CIDR length from the argument of an a or mx mechanism
+func splitCIDR(arg string) (string, int, int, error) {
+	ip4Len, ip6Len := 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n > 128 {
+			return arg, ip4Len, ip6Len, fmt.Errorf("Invalid CIDR length in %s", arg)
+		}
+		arg, ip6Len = arg[:i], n
+	}
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n > 32 {
+			return arg, ip4Len, ip6Len, fmt.Errorf("Invalid CIDR length in %s", arg)
+		}
+		arg, ip4Len = arg[:i], n
+	}
+
+	return arg, ip4Len, ip6Len, nil
+}
+
+// expand expands the macros in a domain specification (RFC 7208 section 7)
+func (c *spfCheck) expand(spec string, domain string) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("Invalid macro in %s", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("Invalid macro in %s", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("Invalid macro in %s", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = c.sender[:strings.LastIndex(c.sender, "@")]
+		case "o":
+			value = c.sender[strings.LastIndex(c.sender, "@")+1:]
+		case "d":
+			value = domain
+		case "i":
+			if ip4 := c.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				nibbles := []string{}
+				for _, b := range c.ip.To16() {
+					nibbles = append(nibbles, fmt.Sprintf("%x.%x", b>>4, b&0xf))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		case "v":
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case "h":
+			value = c.helo
+		default:
+			return "", fmt.Errorf("Unsupported macro %s in %s", macro, spec)
+		}
+
+		// Transformers: an optional number of parts to keep, reversal and delimiters
+		transformers := macro[1:]
+		digits := 0
+		for digits < len(transformers) && transformers[digits] >= '0' && transformers[digits] <= '9' {
+			digits++
+		}
+		keep := 0
+		if digits > 0 {
+			keep, _ = strconv.Atoi(transformers[:digits])
+		}
+		transformers = transformers[digits:]
+		reverse := strings.HasPrefix(strings.ToLower(transformers), "r")
+		if reverse {
+			transformers = transformers[1:]
+		}
+		delimiters := "."
+		if transformers != "" {
+			delimiters = transformers
+		}
+
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		out.WriteString(strings.Join(parts, "."))
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,135 @@
+package list
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	resolver := stubResolver{
+		txt: map[string][]string{
+			"example.com":          {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a mx include:_spf.example.net -all"},
+			"_spf.example.net":     {"v=spf1 ip4:198.51.100.7 ~all"},
+			"soft.example.com":     {"v=spf1 ~all"},
+			"neutral.example.com":  {"v=spf1 ?all"},
+			"noall.example.com":    {"v=spf1 ip4:192.0.2.1"},
+			"redirect.example.com": {"v=spf1 redirect=example.com"},
+			"dangling.example.com": {"v=spf1 redirect=nospf.example.com"},
+			"nospf.example.com":    {"some other record"},
+			"twice.example.com":    {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.example.com":  {"v=spf1 foo:bar -all"},
+			"modifier.example.com": {"v=spf1 exp=explain.example.com ip4:192.0.2.1 -all"},
+			"cidr.example.com":     {"v=spf1 a:host.example.com/24 -all"},
+			"macro.example.com":    {"v=spf1 exists:%{ir}.%{l}._spf.%{d} -all"},
+			"include.example.com":  {"v=spf1 include:nospf.example.com -all"},
+			"helo.example.org":     {"v=spf1 a -all"},
+			"loop.example.com":     {"v=spf1 include:loop.example.com -all"},
+			"voids.example.com":    {"v=spf1 a:void1.example.com a:void2.example.com a:void3.example.com ip4:192.0.2.1 -all"},
+			"hosts.example.com":    {"v=spf1 a:host.example.com a:mx1.example.com a:helo.example.org -all"},
+			"temp.example.com":     {"v=spf1 a:broken.example.com -all"},
+		},
+		ip: map[string][]net.IP{
+			"example.com":                          {net.ParseIP("203.0.113.10")},
+			"mx1.example.com":                      {net.ParseIP("203.0.113.20"), net.ParseIP("2001:db8:ffff::20")},
+			"host.example.com":                     {net.ParseIP("203.0.113.30")},
+			"helo.example.org":                     {net.ParseIP("203.0.113.40")},
+			"1.2.0.192.bob._spf.macro.example.com": {net.ParseIP("127.0.0.2")},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx1.example.com"},
+		},
+		fail: map[string]bool{
+			"broken.example.com": true,
+		},
+	}
+
+	tests := []struct {
+		ip     string
+		sender string
+		helo   string
+		result string
+	}{
+		{"192.0.2.55", "bob@example.com", "", SPFPass},
+		{"2001:db8:1::1", "bob@example.com", "", SPFPass},
+		{"203.0.113.10", "bob@example.com", "", SPFPass},
+		{"203.0.113.20", "bob@example.com", "", SPFPass},
+		{"2001:db8:ffff::20", "bob@example.com", "", SPFPass},
+		{"198.51.100.7", "bob@example.com", "", SPFPass},
+		{"198.51.100.8", "bob@example.com", "", SPFFail},
+		{"198.51.100.8", "bob@soft.example.com", "", SPFSoftFail},
+		{"198.51.100.8", "bob@neutral.example.com", "", SPFNeutral},
+		{"198.51.100.8", "bob@noall.example.com", "", SPFNeutral},
+		{"192.0.2.1", "bob@noall.example.com", "", SPFPass},
+		{"192.0.2.55", "bob@redirect.example.com", "", SPFPass},
+		{"198.51.100.8", "bob@redirect.example.com", "", SPFFail},
+		{"192.0.2.1", "bob@dangling.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@nospf.example.com", "", SPFNone},
+		{"192.0.2.1", "bob@nowhere.example.com", "", SPFNone},
+		{"192.0.2.1", "bob@twice.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@unknown.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@modifier.example.com", "", SPFPass},
+		{"203.0.113.99", "bob@cidr.example.com", "", SPFPass},
+		{"203.0.114.30", "bob@cidr.example.com", "", SPFFail},
+		{"192.0.2.1", "bob@macro.example.com", "", SPFPass},
+		{"192.0.2.1", "carol@macro.example.com", "", SPFFail},
+		{"192.0.2.1", "bob@include.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@loop.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@voids.example.com", "", SPFPermError},
+		{"192.0.2.1", "bob@hosts.example.com", "", SPFFail},
+		{"192.0.2.1", "bob@temp.example.com", "", SPFTempError},
+		// The null sender is checked against the HELO name
+		{"203.0.113.40", "", "helo.example.org", SPFPass},
+		{"203.0.113.41", "", "helo.example.org", SPFFail},
+	}
+
+	for _, test := range tests {
+		result, _ := checkSPF(resolver, net.ParseIP(test.ip), test.sender, test.helo)
+		if result != test.result {
+			t.Errorf("checkSPF(%s, %q, %q) = %s, want %s", test.ip, test.sender, test.helo, result, test.result)
+		}
+	}
+}
+
+func TestSPFExpand(t *testing.T) {
+	c := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+
+	// Examples of RFC 7208, section 7.4
+	tests := map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d3}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":  "bad.strong.lp._spf.example.com",
+		"%{h}%%%_%-":            "mx.example.org% %20",
+	}
+
+	for spec, want := range tests {
+		got, err := c.expand(spec, "email.example.com")
+		if err != nil || got != want {
+			t.Errorf("expand(%q) = %q, %v, want %q", spec, got, err, want)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	if want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"; got != want {
+		t.Errorf("expand IPv6 = %q, want %q", got, want)
+	}
+
+	for _, spec := range []string{"%", "%x", "%{x}", "%{}"} {
+		if _, err := c.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("expand(%q): expected an error", spec)
+		}
+	}
+}
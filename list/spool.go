@@ -0,0 +1,45 @@
+package list
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spoolSize is the size above which a received message is spooled to a temporary
+// file, which is mapped in memory where the platform allows it
+var spoolSize int64 = 1 << 20
+
+// spool reads a received message. Small messages are read in memory, larger ones
+// are written to a temporary file first, so that they are paged in from disk as
+// they are used. The data must not be used after release is called.
+func spool(stream io.Reader) (data []byte, release func(), err error) {
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, stream, spoolSize+1)
+	if err == io.EOF {
+		return buf.Bytes(), func() {}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := ioutil.TempFile("", "tinylist")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The mapping outlives the file
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = buf.WriteTo(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := io.Copy(f, stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mapFile(f, spoolSize+1+size)
+}
@@ -0,0 +1,22 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package list
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads a file in memory, as it cannot be mapped on this platform
+func mapFile(f *os.File, size int64) ([]byte, func(), error) {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
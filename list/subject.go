@@ -0,0 +1,114 @@
+package list
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// replyPrefixes are the prefixes that mail clients put in front of the subject of a reply, in several languages
+var replyPrefixes = []string{"re", "aw", "sv", "vs", "antw", "odp", "ynt"}
+
+// forwardPrefixes are the prefixes that mail clients put in front of the subject of a forwarded message
+var forwardPrefixes = []string{"fwd", "fw", "wg", "tr", "doorst", "enc", "rv"}
+
+// stripPrefix removes one of the given prefixes, followed by a colon. A counter
+// as in "Re[2]:" or "Re(2):" is allowed.
+func stripPrefix(subject string, prefixes []string) (string, bool) {
+	i := strings.Index(subject, ":")
+	if i < 0 {
+		return subject, false
+	}
+
+	word := strings.ToLower(strings.TrimSpace(subject[:i]))
+	if j := strings.IndexAny(word, "[("); j > 0 && isCounter(word[j:]) {
+		word = word[:j]
+	}
+
+	for _, prefix := range prefixes {
+		if word == prefix {
+			return strings.TrimSpace(subject[i+1:]), true
+		}
+	}
+	return subject, false
+}
+
+// isCounter checks whether s is a reply counter like "[2]" or "(2)"
+func isCounter(s string) bool {
+	if len(s) < 3 || s[0] == '[' && s[len(s)-1] != ']' || s[0] == '(' && s[len(s)-1] != ')' {
+		return false
+	}
+	return strings.Trim(s[1:len(s)-1], "0123456789") == ""
+}
+
+// commandFromSubject decodes a subject, and strips the reply and forward prefixes that mail clients put in front of a command
+func commandFromSubject(subject string) string {
+	decoded, err := commandDecoder.DecodeHeader(subject)
+	if err == nil {
+		subject = decoded
+	}
+
+	command := normalizeCommand(subject)
+	for {
+		rest, ok := stripPrefix(command, replyPrefixes)
+		if !ok {
+			rest, ok = stripPrefix(command, forwardPrefixes)
+		}
+		if !ok {
+			return command
+		}
+		command = rest
+	}
+}
+
+// normalizeCommand replaces the typographic spaces and quotes that clients put in text
+func normalizeCommand(command string) string {
+	command = strings.NewReplacer("\u00a0", " ", "\u2018", "'", "\u2019", "'", "\u201c", "\"", "\u201d", "\"").Replace(command)
+	return strings.TrimSpace(command)
+}
+
+// prefixSubject puts a list prefix in front of a subject. Existing prefixes are removed
+// first, and reply prefixes are collapsed, to avoid subjects like "Re: [list] Re: [list] ..."
+func prefixSubject(subject string, prefix string) string {
+	if prefix == "" {
+		return subject
+	}
+
+	decoded, err := headerDecoder.DecodeHeader(subject)
+	if err != nil {
+		// Unknown charset - leave the encoded words as they are
+		decoded = subject
+	}
+
+	// Strip the list prefix where it is a leading tag, possibly after reply prefixes
+	rest := strings.TrimSpace(decoded)
+	reply := false
+	for {
+		if strings.HasPrefix(rest, prefix) {
+			rest = strings.TrimSpace(rest[len(prefix):])
+			continue
+		}
+		stripped, ok := stripPrefix(rest, replyPrefixes)
+		if !ok {
+			break
+		}
+		rest, reply = stripped, true
+	}
+
+	result := prefix
+	if reply {
+		result += " Re:"
+	}
+	if rest != "" {
+		result += " " + rest
+	}
+	return result
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
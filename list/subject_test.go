@@ -0,0 +1,95 @@
+package list
+
+import "testing"
+
+func TestPrefixSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		prefix  string
+		result  string
+	}{
+		{"Hello", "", "Hello"},
+		{"Hello", "[x]", "[x] Hello"},
+		{"", "[x]", "[x]"},
+		{"[x] Hello", "[x]", "[x] Hello"},
+		{"[x]Hello", "[x]", "[x] Hello"},
+		{"Re: Hello", "[x]", "[x] Re: Hello"},
+		{"Re: [x] Hello", "[x]", "[x] Re: Hello"},
+		{"Re: [x] Re: [x] Hello", "[x]", "[x] Re: Hello"},
+		{"[x] Re: [x] Re: Hello", "[x]", "[x] Re: Hello"},
+		{"RE: Re[2]: [x] Hello", "[x]", "[x] Re: Hello"},
+		{"AW: [x] Hello", "[x]", "[x] Re: Hello"},
+		{"Sv: Antw: [x] Hello", "[x]", "[x] Re: Hello"},
+		{"Fwd: [x] Hello", "[x]", "[x] Fwd: [x] Hello"},
+		{"Hello [x] world", "[x]", "[x] Hello [x] world"},
+		{"Re: Hello [x]", "[x]", "[x] Re: Hello [x]"},
+		{"Rematch: Hello", "[x]", "[x] Rematch: Hello"},
+		{"=?UTF-8?Q?Re:_[x]_Gr=C3=BC=C3=9Fe?=", "[x]", "[x] Re: Grüße"},
+		{"=?UTF-8?B?W3hdIEdyw7zDn2U=?=", "[x]", "[x] Grüße"},
+		{"=?ISO-8859-1?Q?Gr=FC=DFe?=", "[x]", "[x] Grüße"},
+		{"=?windows-1252?Q?=80uro?=", "[x]", "[x] €uro"},
+		{"=?x-unknown?Q?Hi?=", "[x]", "[x] =?x-unknown?Q?Hi?="},
+	}
+
+	for _, test := range tests {
+		if result := prefixSubject(test.subject, test.prefix); result != test.result {
+			t.Errorf("prefixSubject(%q, %q) = %q, want %q", test.subject, test.prefix, result, test.result)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		subject string
+		result  string
+		ok      bool
+	}{
+		{"Re: help", "help", true},
+		{"RE:help", "help", true},
+		{"AW: help", "help", true},
+		{"Re[2]: help", "help", true},
+		{"Re(3): help", "help", true},
+		{"Re[]: help", "Re[]: help", false},
+		{"Re[x]: help", "Re[x]: help", false},
+		{"Re[2: help", "Re[2: help", false},
+		{"Re(2]: help", "Re(2]: help", false},
+		{"Regarding: help", "Regarding: help", false},
+		{"help", "help", false},
+		{"confirm abc: def", "confirm abc: def", false},
+	}
+
+	for _, test := range tests {
+		result, ok := stripPrefix(test.subject, replyPrefixes)
+		if result != test.result || ok != test.ok {
+			t.Errorf("stripPrefix(%q) = %q, %v, want %q, %v", test.subject, result, ok, test.result, test.ok)
+		}
+	}
+}
+
+func TestCommandFromSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		command string
+	}{
+		{"help", "help"},
+		{"  help  ", "help"},
+		{"Re: confirm 0123", "confirm 0123"},
+		{"AW: Re: confirm 0123", "confirm 0123"},
+		{"Re[2]: Fwd: confirm 0123", "confirm 0123"},
+		{"WG: TR: subscribe list@example.com", "subscribe list@example.com"},
+		{"=?UTF-8?Q?AW:_Re:_help?=", "help"},
+		{"AW: Re: =?UTF-8?Q?help?=", "help"},
+		{"=?UTF-8?B?c3Vic2NyaWJlIGxpc3RAZXhhbXBsZS5jb20=?=", "subscribe list@example.com"},
+		{"=?ISO-8859-1?Q?Re:_reject_0123_b=E8te?=", "reject 0123 bète"},
+		{"=?windows-1252?Q?reject_0123_=93spam=94?=", "reject 0123 \"spam\""},
+		{"=?koi8-r?Q?confirm_0123?=", "confirm 0123"},
+		{"=?x-unknown?Q?Re:_confirm_0123_=FF?=", "confirm 0123 �"},
+		{"unsubscribe list@example.com", "unsubscribe list@example.com"},
+	}
+
+	for _, test := range tests {
+		if command := commandFromSubject(test.subject); command != test.command {
+			t.Errorf("commandFromSubject(%q) = %q, want %q", test.subject, command, test.command)
+		}
+	}
+}
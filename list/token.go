@@ -0,0 +1,50 @@
+package list
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNoSecret is returned when a token is needed, but no secret is configured to sign it
+var ErrNoSecret = errors.New("No secret configured to sign tokens")
+
+// signToken creates a token that authenticates the given fields until expires, using the configured secret
+func signToken(secret string, expires time.Time, fields ...string) string {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(expires.Unix()))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+
+	return hex.EncodeToString(append(data, mac.Sum(nil)[:16]...))
+}
+
+// verifyToken checks whether a token was created by signToken for the given fields and has not expired yet
+func verifyToken(secret string, token string, fields ...string) error {
+	// Anyone can forge a token signed with an empty secret
+	if secret == "" {
+		return ErrNoSecret
+	}
+
+	data, err := hex.DecodeString(strings.ToLower(token))
+	if err != nil || len(data) != 24 {
+		return errors.New("Invalid token")
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	if !hmac.Equal([]byte(signToken(secret, expires, fields...)), []byte(strings.ToLower(token))) {
+		return errors.New("Invalid token")
+	}
+
+	if time.Now().After(expires) {
+		return errors.New("Token has expired")
+	}
+
+	return nil
+}
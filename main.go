@@ -24,8 +24,21 @@ func run(params []string) error {
 	configFile := app.Flag("config", "Load configuration from specified file").Default("").String()
 
 	app.Command("check", "Check the configuration").Action(backend.check)
-	app.Command("message", "Process a message from stdin").Action(backend.message)
-	list.AddCommand(app, true, "", list.NewBotFactory(backend))
+	message := app.Command("message", "Process a message from stdin").Action(backend.message)
+	message.Flag("sender", "Envelope sender of the message, to check SPF").StringVar(&backend.envelope.Sender)
+	message.Flag("client-ip", "Address of the SMTP client that delivered the message, to check SPF").StringVar(&backend.envelope.ClientIP)
+	message.Flag("helo", "HELO name of the SMTP client that delivered the message").StringVar(&backend.envelope.Helo)
+	digest := app.Command("digest", "Send digests to subscribers in digest mode, to be run periodically").Action(backend.sendDigests)
+	digest.Flag("interval", "Time between two digests").Default("24h").DurationVar(&backend.digest.Interval)
+	digest.Flag("max-messages", "Send a digest early once this many messages are waiting, 0 to disable").Default("0").IntVar(&backend.digest.MaxMessages)
+	digest.Flag("max-size", "Send a digest early once the waiting messages exceed this many bytes, 0 to disable").Default("0").Int64Var(&backend.digest.MaxSize)
+	queue := app.Command("queue", "Manage the outbound queue of deliveries that failed")
+	queue.Command("run", "Retry the queued deliveries that are due, to be run periodically").Action(backend.runQueue)
+	queue.Command("list", "List the queued deliveries").Action(backend.listQueue)
+	queue.Command("flush", "Retry all pending deliveries now").Action(backend.flushQueue)
+	serveHTTP := app.Command("serve-http", "Serve one-click unsubscribe requests over HTTP").Action(backend.serveHTTP)
+	serveHTTP.Flag("listen", "Address to listen on").Default(":8080").StringVar(&backend.listen)
+	list.AddCommand(app, list.RoleAdmin, "", list.NewBotFactory(backend))
 
 	app.Action(func(*kingpin.ParseContext) error {
 		return backend.LoadConfig(*configFile, *debug)
@@ -8,8 +8,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/smtp"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -26,6 +28,9 @@ type SQLBackend struct {
 	Database string `ini:"database"`
 	config   list.Config
 	db       *sql.DB
+	listen   string
+	digest   list.DigestOptions
+	envelope list.Envelope
 }
 
 // NewSQLBackend from the on-disk config file
@@ -76,6 +81,7 @@ func (b *SQLBackend) openDB() (err error) {
 	var (
 		driver  string
 		queries []string
+		columns []tableColumn
 	)
 
 	switch b.Driver {
@@ -89,7 +95,21 @@ func (b *SQLBackend) openDB() (err error) {
 				description VARCHAR(255) NOT NULL,
 				hidden INTEGER(1) NOT NULL,
 				locked INTEGER(1) NOT NULL,
-				subscribers_only INTEGER(1) NOT NULL
+				subscribers_only INTEGER(1) NOT NULL,
+				moderation VARCHAR(16) NOT NULL DEFAULT 'reject',
+				subject_prefix VARCHAR(255) NOT NULL DEFAULT '',
+				footer TEXT NOT NULL,
+				dmarc_mitigation VARCHAR(16) NOT NULL DEFAULT 'none',
+				dkim_domain VARCHAR(255) NOT NULL DEFAULT '',
+				dkim_selector VARCHAR(255) NOT NULL DEFAULT '',
+				dkim_key VARCHAR(255) NOT NULL DEFAULT '',
+				authenticated INTEGER(1) NOT NULL DEFAULT 0,
+				reply_to VARCHAR(16) NOT NULL DEFAULT 'poster',
+				reply_to_address VARCHAR(255) NOT NULL DEFAULT '',
+				merge_reply_to INTEGER(1) NOT NULL DEFAULT 0,
+				archive_url VARCHAR(255) NOT NULL DEFAULT '',
+				help_url VARCHAR(255) NOT NULL DEFAULT '',
+				owner_url VARCHAR(255) NOT NULL DEFAULT ''
 			)`,
 			`CREATE TABLE IF NOT EXISTS bcc (
 				list VARCHAR(255) NOT NULL,
@@ -101,14 +121,33 @@ func (b *SQLBackend) openDB() (err error) {
 				address VARCHAR(255) NOT NULL,
 				UNIQUE KEY list_address (list,address)
 			)`,
+			`CREATE TABLE IF NOT EXISTS owners (
+				list VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				UNIQUE KEY list_address (list,address)
+			)`,
+			`CREATE TABLE IF NOT EXISTS moderators (
+				list VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				UNIQUE KEY list_address (list,address)
+			)`,
 			`CREATE TABLE IF NOT EXISTS subscriptions (
 				list VARCHAR(255) NOT NULL,
 				user VARCHAR(255) NOT NULL,
+				mode VARCHAR(16) NOT NULL DEFAULT 'regular',
 				bounces INTEGER NOT NULL DEFAULT 0,
 				last_bounce DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00',
 				comment VARCHAR(255),
 				UNIQUE KEY list_user (list,user)
 			)`,
+			`CREATE TABLE IF NOT EXISTS pending_subscriptions (
+				list VARCHAR(255) NOT NULL,
+				user VARCHAR(255) NOT NULL,
+				token VARCHAR(255) NOT NULL,
+				expires DATETIME NOT NULL,
+				UNIQUE KEY list_user (list,user),
+				UNIQUE KEY token (token)
+			)`,
 			`CREATE TABLE IF NOT EXISTS archive (
 				list VARCHAR(255) NOT NULL,
 				id VARCHAR(255) NOT NULL,
@@ -117,7 +156,67 @@ func (b *SQLBackend) openDB() (err error) {
 				date DATETIME NOT NULL,
 				message LONGBLOB NOT NULL,
 				UNIQUE KEY list_id (list,id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS digests (
+				list VARCHAR(255) PRIMARY KEY,
+				last_digest DATETIME NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS replies (
+				address VARCHAR(255) NOT NULL,
+				date DATETIME NOT NULL,
+				KEY address_date (address,date)
+			)`,
+			`CREATE TABLE IF NOT EXISTS held_messages (
+				list VARCHAR(255) NOT NULL,
+				token VARCHAR(255) NOT NULL,
+				sender VARCHAR(255) NOT NULL,
+				subject VARCHAR(255) NOT NULL,
+				expires DATETIME NOT NULL,
+				message LONGBLOB NOT NULL,
+				auth_results TEXT NOT NULL,
+				UNIQUE KEY token (token)
+			)`,
+			`CREATE TABLE IF NOT EXISTS queued_messages (
+				id VARCHAR(255) PRIMARY KEY,
+				list VARCHAR(255) NOT NULL,
+				sender VARCHAR(255) NOT NULL,
+				subject VARCHAR(255) NOT NULL,
+				created DATETIME NOT NULL,
+				arc_instance INTEGER NOT NULL DEFAULT 0,
+				arc_results TEXT NOT NULL,
+				arc_chain_validation VARCHAR(16) NOT NULL DEFAULT '',
+				message LONGBLOB NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS queue (
+				id VARCHAR(255) NOT NULL,
+				recipient VARCHAR(255) NOT NULL,
+				status VARCHAR(16) NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt DATETIME NOT NULL,
+				error TEXT NOT NULL,
+				UNIQUE KEY id_recipient (id,recipient)
+			)`,
+			`CREATE TABLE IF NOT EXISTS migrations (
+				name VARCHAR(255) PRIMARY KEY
 			)`)
+
+		columns = append(columns,
+			tableColumn{"subscriptions", "mode", "VARCHAR(16) NOT NULL DEFAULT 'regular'"},
+			tableColumn{"lists", "moderation", "VARCHAR(16) NOT NULL DEFAULT 'reject'"},
+			tableColumn{"lists", "subject_prefix", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "footer", "TEXT NOT NULL"},
+			tableColumn{"lists", "dmarc_mitigation", "VARCHAR(16) NOT NULL DEFAULT 'none'"},
+			tableColumn{"lists", "dkim_domain", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "dkim_selector", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "dkim_key", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "authenticated", "INTEGER(1) NOT NULL DEFAULT 0"},
+			tableColumn{"lists", "reply_to", "VARCHAR(16) NOT NULL DEFAULT 'poster'"},
+			tableColumn{"lists", "reply_to_address", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "merge_reply_to", "INTEGER(1) NOT NULL DEFAULT 0"},
+			tableColumn{"lists", "archive_url", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "help_url", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "owner_url", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			tableColumn{"held_messages", "auth_results", "TEXT NOT NULL"})
 	default:
 		driver = "sqlite3"
 
@@ -128,7 +227,21 @@ func (b *SQLBackend) openDB() (err error) {
 				description TEXT NOT NULL,
 				hidden INTEGER(1) NOT NULL,
 				locked INTEGER(1) NOT NULL,
-				subscribers_only INTEGER(1) NOT NULL
+				subscribers_only INTEGER(1) NOT NULL,
+				moderation TEXT NOT NULL DEFAULT 'reject',
+				subject_prefix TEXT NOT NULL DEFAULT '',
+				footer TEXT NOT NULL DEFAULT '',
+				dmarc_mitigation TEXT NOT NULL DEFAULT 'none',
+				dkim_domain TEXT NOT NULL DEFAULT '',
+				dkim_selector TEXT NOT NULL DEFAULT '',
+				dkim_key TEXT NOT NULL DEFAULT '',
+				authenticated INTEGER(1) NOT NULL DEFAULT 0,
+				reply_to TEXT NOT NULL DEFAULT 'poster',
+				reply_to_address TEXT NOT NULL DEFAULT '',
+				merge_reply_to INTEGER(1) NOT NULL DEFAULT 0,
+				archive_url TEXT NOT NULL DEFAULT '',
+				help_url TEXT NOT NULL DEFAULT '',
+				owner_url TEXT NOT NULL DEFAULT ''
 			)`,
 			`CREATE TABLE IF NOT EXISTS bcc (
 				list TEXT NOT NULL,
@@ -140,13 +253,32 @@ func (b *SQLBackend) openDB() (err error) {
 				address TEXT NOT NULL,
 				UNIQUE(list,address)
 			)`,
+			`CREATE TABLE IF NOT EXISTS owners (
+				list TEXT NOT NULL,
+				address TEXT NOT NULL,
+				UNIQUE(list,address)
+			)`,
+			`CREATE TABLE IF NOT EXISTS moderators (
+				list TEXT NOT NULL,
+				address TEXT NOT NULL,
+				UNIQUE(list,address)
+			)`,
 			`CREATE TABLE IF NOT EXISTS subscriptions (
 				list TEXT NOT NULL,
 				user TEXT NOT NULL,
+				mode TEXT NOT NULL DEFAULT 'regular',
 				bounces INTEGER NOT NULL DEFAULT 0,
 				last_bounce DATETIME NOT NULL DEFAULT 0,
 				UNIQUE(list,user)
 			)`,
+			`CREATE TABLE IF NOT EXISTS pending_subscriptions (
+				list TEXT NOT NULL,
+				user TEXT NOT NULL,
+				token TEXT NOT NULL,
+				expires DATETIME NOT NULL,
+				UNIQUE(list,user),
+				UNIQUE(token)
+			)`,
 			`CREATE TABLE IF NOT EXISTS archive (
 				list TEXT NOT NULL,
 				id TEXT NOT NULL,
@@ -155,7 +287,67 @@ func (b *SQLBackend) openDB() (err error) {
 				date DATETIME NOT NULL,
 				message BLOB NOT NULL,
 				UNIQUE(list,id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS digests (
+				list TEXT PRIMARY KEY,
+				last_digest DATETIME NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS replies (
+				address TEXT NOT NULL,
+				date DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS replies_address_date ON replies (address,date)`,
+			`CREATE TABLE IF NOT EXISTS held_messages (
+				list TEXT NOT NULL,
+				token TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				expires DATETIME NOT NULL,
+				message BLOB NOT NULL,
+				auth_results TEXT NOT NULL DEFAULT '',
+				UNIQUE(token)
+			)`,
+			`CREATE TABLE IF NOT EXISTS queued_messages (
+				id TEXT PRIMARY KEY,
+				list TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				created DATETIME NOT NULL,
+				arc_instance INTEGER NOT NULL DEFAULT 0,
+				arc_results TEXT NOT NULL DEFAULT '',
+				arc_chain_validation TEXT NOT NULL DEFAULT '',
+				message BLOB NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS queue (
+				id TEXT NOT NULL,
+				recipient TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt DATETIME NOT NULL,
+				error TEXT NOT NULL DEFAULT '',
+				UNIQUE(id,recipient)
+			)`,
+			`CREATE TABLE IF NOT EXISTS migrations (
+				name TEXT PRIMARY KEY
 			)`)
+
+		columns = append(columns,
+			tableColumn{"subscriptions", "mode", "TEXT NOT NULL DEFAULT 'regular'"},
+			tableColumn{"lists", "moderation", "TEXT NOT NULL DEFAULT 'reject'"},
+			tableColumn{"lists", "subject_prefix", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "footer", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "dmarc_mitigation", "TEXT NOT NULL DEFAULT 'none'"},
+			tableColumn{"lists", "dkim_domain", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "dkim_selector", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "dkim_key", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "authenticated", "INTEGER(1) NOT NULL DEFAULT 0"},
+			tableColumn{"lists", "reply_to", "TEXT NOT NULL DEFAULT 'poster'"},
+			tableColumn{"lists", "reply_to_address", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "merge_reply_to", "INTEGER(1) NOT NULL DEFAULT 0"},
+			tableColumn{"lists", "archive_url", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "help_url", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"lists", "owner_url", "TEXT NOT NULL DEFAULT ''"},
+			tableColumn{"held_messages", "auth_results", "TEXT NOT NULL DEFAULT ''"})
 	}
 
 	b.db, err = sql.Open(driver, b.Database)
@@ -170,9 +362,136 @@ func (b *SQLBackend) openDB() (err error) {
 		}
 	}
 
+	for _, column := range columns {
+		err = b.addColumn(column)
+		if err != nil {
+			return
+		}
+	}
+
+	return b.migrate("normalize_addresses", b.normalizeAddresses)
+}
+
+// migrate converts the data of an older version once, and records it by name
+func (b *SQLBackend) migrate(name string, migration func() error) error {
+	var n int
+	err := b.db.QueryRow("SELECT COUNT(*) FROM migrations WHERE name=?", name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	err = migration()
+	if err != nil {
+		return fmt.Errorf("Migration %s failed: %s", name, err.Error())
+	}
+
+	_, err = b.db.Exec("INSERT INTO migrations (name) VALUES(?)", name)
+	return err
+}
+
+// normalizeAddresses stores the addresses of subscribers, posters, bcc, owners and
+// moderators in the form they are compared in. Older versions only lowercased them.
+func (b *SQLBackend) normalizeAddresses() error {
+	tables := []struct {
+		table  string
+		column string
+	}{
+		{"subscriptions", "user"},
+		{"posters", "address"},
+		{"bcc", "address"},
+		{"owners", "address"},
+		{"moderators", "address"},
+	}
+
+	for _, t := range tables {
+		err := b.normalizeColumn(t.table, t.column)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeColumn normalizes the addresses in a column of a table with a list column.
+// Rows that end up equal to an existing row are removed.
+func (b *SQLBackend) normalizeColumn(table string, column string) error {
+	rows, err := b.db.Query(fmt.Sprintf("SELECT list, %s FROM %s", column, table))
+	if err != nil {
+		return err
+	}
+
+	type change struct {
+		list       string
+		address    string
+		normalized string
+	}
+
+	changes := []change{}
+	for rows.Next() {
+		c := change{}
+		err = rows.Scan(&c.list, &c.address)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		c.normalized = list.CanonicalAddress(c.address)
+		if c.normalized != c.address {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		var n int
+		err = tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE list=? AND %s=?", table, column), c.list, c.normalized).Scan(&n)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if n > 0 {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE list=? AND %s=?", table, column), c.list, c.address)
+		} else {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s=? WHERE list=? AND %s=?", table, column, column), c.normalized, c.list, c.address)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	tx.Commit()
 	return nil
 }
 
+// A tableColumn describes a column that was added to a table after its creation
+type tableColumn struct {
+	table      string
+	column     string
+	definition string
+}
+
+// addColumn adds a column to a table created by an older version, if it is missing
+func (b *SQLBackend) addColumn(c tableColumn) error {
+	rows, err := b.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE 1=0", c.column, c.table))
+	if err == nil {
+		return rows.Close()
+	}
+
+	_, err = b.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+	return err
+}
+
 func (b *SQLBackend) openLog() error {
 	logFile, err := os.OpenFile(b.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
@@ -189,6 +508,11 @@ func (b *SQLBackend) check(*kingpin.ParseContext) error {
 		return fmt.Errorf("There's a problem with the log: %s", err.Error())
 	}
 
+	err = b.requireSecret()
+	if err != nil {
+		return err
+	}
+
 	client, err := smtp.Dial(fmt.Sprintf("%s:%d", b.config.SMTPHostname, b.config.SMTPPort))
 	if err != nil {
 		return fmt.Errorf("There's a problem connecting to your SMTP server: %s", err.Error())
@@ -205,6 +529,14 @@ func (b *SQLBackend) check(*kingpin.ParseContext) error {
 	return nil
 }
 
+// requireSecret checks that a secret is configured, as tokens signed without one can be forged
+func (b *SQLBackend) requireSecret() error {
+	if b.config.Secret == "" {
+		return fmt.Errorf("There's no secret configured to sign confirmation tokens")
+	}
+	return nil
+}
+
 func (b *SQLBackend) message(*kingpin.ParseContext) error {
 	err := b.openLog()
 	if err != nil {
@@ -212,7 +544,64 @@ func (b *SQLBackend) message(*kingpin.ParseContext) error {
 	}
 
 	bot := list.NewBot(b)
-	return bot.Handle(bufio.NewReader(os.Stdin))
+	return bot.Handle(bufio.NewReader(os.Stdin), b.envelope)
+}
+
+func (b *SQLBackend) serveHTTP(*kingpin.ParseContext) error {
+	err := b.openLog()
+	if err != nil {
+		return err
+	}
+
+	err = b.requireSecret()
+	if err != nil {
+		return err
+	}
+
+	bot := list.NewBot(b)
+	return http.ListenAndServe(b.listen, bot)
+}
+
+func (b *SQLBackend) sendDigests(*kingpin.ParseContext) error {
+	err := b.openLog()
+	if err != nil {
+		return err
+	}
+
+	bot := list.NewBot(b)
+	return bot.SendDigests(b.digest)
+}
+
+func (b *SQLBackend) runQueue(*kingpin.ParseContext) error {
+	err := b.openLog()
+	if err != nil {
+		return err
+	}
+
+	bot := list.NewBot(b)
+	return bot.RunQueue(false)
+}
+
+func (b *SQLBackend) flushQueue(*kingpin.ParseContext) error {
+	err := b.openLog()
+	if err != nil {
+		return err
+	}
+
+	bot := list.NewBot(b)
+	return bot.RunQueue(true)
+}
+
+func (b *SQLBackend) listQueue(*kingpin.ParseContext) error {
+	messages, err := b.Queued()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range messages {
+		fmt.Println(q.String())
+	}
+	return nil
 }
 
 func (b *SQLBackend) Config() list.Config {
@@ -221,7 +610,7 @@ func (b *SQLBackend) Config() list.Config {
 
 // Lists returns all lists
 func (c *SQLBackend) Lists() ([]list.Definition, error) {
-	rows, err := c.db.Query("SELECT list, name, description, hidden, locked, subscribers_only FROM lists ORDER BY list")
+	rows, err := c.db.Query("SELECT list, name, description, hidden, locked, subscribers_only, moderation, subject_prefix, footer, dmarc_mitigation, dkim_domain, dkim_selector, dkim_key, authenticated, reply_to, reply_to_address, merge_reply_to, archive_url, help_url, owner_url FROM lists ORDER BY list")
 	if err != nil {
 		return nil, err
 	}
@@ -244,26 +633,22 @@ func (c *SQLBackend) Lists() ([]list.Definition, error) {
 
 // LookupList returns a specific list, or nil if not found
 func (b *SQLBackend) LookupList(name string) (*list.Definition, error) {
-	row := b.db.QueryRow("SELECT list, name, description, hidden, locked, subscribers_only FROM lists WHERE list=?", name)
+	row := b.db.QueryRow("SELECT list, name, description, hidden, locked, subscribers_only, moderation, subject_prefix, footer, dmarc_mitigation, dkim_domain, dkim_selector, dkim_key, authenticated, reply_to, reply_to_address, merge_reply_to, archive_url, help_url, owner_url FROM lists WHERE list=?", name)
 
-	if err := row.Err(); errors.Is(err, sql.ErrNoRows) {
+	l, err := b.fetchList(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	l, err := b.fetchList(row.Scan)
-	if err != nil {
-		return nil, err
-	}
-
 	return &l, nil
 }
 
 func (b *SQLBackend) fetchList(scan func(dest ...interface{}) error) (list.Definition, error) {
 	l := list.Definition{}
 
-	err := scan(&l.Address, &l.Name, &l.Description, &l.Hidden, &l.Locked, &l.SubscribersOnly)
+	err := scan(&l.Address, &l.Name, &l.Description, &l.Hidden, &l.Locked, &l.SubscribersOnly, &l.Moderation, &l.SubjectPrefix, &l.Footer, &l.DMARCMitigation, &l.DKIMDomain, &l.DKIMSelector, &l.DKIMKey, &l.Authenticated, &l.ReplyTo, &l.ReplyToAddress, &l.MergeReplyTo, &l.ArchiveURL, &l.HelpURL, &l.OwnerURL)
 	if err != nil {
 		return l, err
 	}
@@ -274,6 +659,16 @@ func (b *SQLBackend) fetchList(scan func(dest ...interface{}) error) (list.Defin
 	}
 
 	l.Bcc, err = b.listBcc(l.Address)
+	if err != nil {
+		return l, err
+	}
+
+	l.Owners, err = b.listOwners(l.Address)
+	if err != nil {
+		return l, err
+	}
+
+	l.Moderators, err = b.listModerators(l.Address)
 	return l, err
 }
 
@@ -319,12 +714,54 @@ func (b *SQLBackend) listBcc(id string) ([]string, error) {
 	return result, rows.Err()
 }
 
+func (b *SQLBackend) listOwners(id string) ([]string, error) {
+	rows, err := b.db.Query("SELECT address FROM owners WHERE list=?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address string
+		err = rows.Scan(&address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, address)
+	}
+
+	return result, rows.Err()
+}
+
+func (b *SQLBackend) listModerators(id string) ([]string, error) {
+	rows, err := b.db.Query("SELECT address FROM moderators WHERE list=?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address string
+		err = rows.Scan(&address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, address)
+	}
+
+	return result, rows.Err()
+}
+
 // ListIsSubscribed method
 func (b *SQLBackend) ListIsSubscribed(l list.Definition, user string) (*list.Subscription, error) {
 	s := &list.Subscription{
 		Address: user,
 	}
-	err := b.db.QueryRow("SELECT bounces, last_bounce FROM subscriptions WHERE user=? AND list=?", user, l.Address).Scan(&s.Bounces, &s.LastBounce)
+	err := b.db.QueryRow("SELECT mode, bounces, last_bounce FROM subscriptions WHERE user=? AND list=?", user, l.Address).Scan(&s.Mode, &s.Bounces, &s.LastBounce)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -337,7 +774,7 @@ func (b *SQLBackend) ListIsSubscribed(l list.Definition, user string) (*list.Sub
 
 // ListSubscribers method
 func (b *SQLBackend) ListSubscribers(l list.Definition) ([]list.Subscription, error) {
-	rows, err := b.db.Query("SELECT user, bounces, last_bounce FROM subscriptions WHERE list=?", l.Address)
+	rows, err := b.db.Query("SELECT user, mode, bounces, last_bounce FROM subscriptions WHERE list=?", l.Address)
 	if err != nil {
 		return nil, err
 	}
@@ -347,7 +784,7 @@ func (b *SQLBackend) ListSubscribers(l list.Definition) ([]list.Subscription, er
 
 	for rows.Next() {
 		s := list.Subscription{}
-		err = rows.Scan(&s.Address, &s.Bounces, &s.LastBounce)
+		err = rows.Scan(&s.Address, &s.Mode, &s.Bounces, &s.LastBounce)
 		if err != nil {
 			return nil, err
 		}
@@ -382,9 +819,9 @@ func (b *SQLBackend) ListUnsubscribe(l list.Definition, user string) error {
 	return nil
 }
 
-// ListSetBounce method
-func (b *SQLBackend) ListSetBounce(l list.Definition, user string, bounces uint16, lastBounce time.Time) error {
-	r, err := b.db.Exec("UPDATE subscriptions SET bounces = ?, last_bounce = ? WHERE user=? AND list=?", bounces, lastBounce, user, l.Address)
+// ListSetMode method
+func (b *SQLBackend) ListSetMode(l list.Definition, user string, mode list.DeliveryMode) error {
+	r, err := b.db.Exec("UPDATE subscriptions SET mode = ? WHERE user=? AND list=?", mode, user, l.Address)
 	if err != nil {
 		return err
 	}
@@ -401,33 +838,350 @@ func (b *SQLBackend) ListSetBounce(l list.Definition, user string, bounces uint1
 	return nil
 }
 
-// ListArchive method.
-func (b *SQLBackend) ListArchive(l list.Definition, msg *list.Message) error {
-	var (
-		data = []byte(msg.String())
-		id   = fmt.Sprintf("%x", sha256.Sum256(data))
-		now  = time.Now()
-	)
-
-	_, err := b.db.Exec(`INSERT INTO archive (list,id,sender,subject,date,message) VALUES(?,?,?,?,?,?)`,
-		l.Address,
-		id,
-		msg.From,
-		msg.Subject,
-		now,
-		data)
-
-	return err
-}
-
-// CreateList method
-func (b *SQLBackend) CreateList(d list.Definition) error {
-	tx, _ := b.db.Begin()
-
-	_, err := tx.Exec("INSERT INTO lists (list, name, description, hidden, locked, subscribers_only) VALUES(?,?,?,?,?,?)",
-		d.Address, d.Name, d.Description, d.Hidden, d.Locked, d.SubscribersOnly)
+// ListSetBounce method
+func (b *SQLBackend) ListSetBounce(l list.Definition, user string, bounces uint16, lastBounce time.Time) error {
+	r, err := b.db.Exec("UPDATE subscriptions SET bounces = ?, last_bounce = ? WHERE user=? AND list=?", bounces, lastBounce, user, l.Address)
 	if err != nil {
-		tx.Rollback()
+		return err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("user %s is not subscribed to list %s", user, l.Address)
+	}
+
+	return nil
+}
+
+// ListAddPending method
+func (b *SQLBackend) ListAddPending(l list.Definition, user string, token string, expires time.Time) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pending_subscriptions WHERE (user=? AND list=?) OR expires<?", user, l.Address, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO pending_subscriptions (user,list,token,expires) VALUES(?,?,?,?)", user, l.Address, token, expires)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ListPending returns the unexpired pending subscription of a user to a list, or nil if not found
+func (b *SQLBackend) ListPending(l list.Definition, user string) (*list.PendingSubscription, error) {
+	p := &list.PendingSubscription{
+		List:    l.Address,
+		Address: user,
+	}
+	err := b.db.QueryRow("SELECT token, expires FROM pending_subscriptions WHERE user=? AND list=? AND expires>?", user, l.Address, time.Now()).Scan(&p.Token, &p.Expires)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// LookupPending returns a pending subscription by its token, or nil if not found
+func (b *SQLBackend) LookupPending(token string) (*list.PendingSubscription, error) {
+	p := &list.PendingSubscription{
+		Token: token,
+	}
+	err := b.db.QueryRow("SELECT list, user, expires FROM pending_subscriptions WHERE token=?", token).Scan(&p.List, &p.Address, &p.Expires)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// DeletePending method
+func (b *SQLBackend) DeletePending(token string) error {
+	_, err := b.db.Exec("DELETE FROM pending_subscriptions WHERE token=?", token)
+	return err
+}
+
+// ListHold method
+func (b *SQLBackend) ListHold(l list.Definition, h list.HeldMessage) error {
+	_, err := b.db.Exec("DELETE FROM held_messages WHERE expires<?", time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec("INSERT INTO held_messages (list,token,sender,subject,expires,message,auth_results) VALUES(?,?,?,?,?,?,?)",
+		l.Address, h.Token, h.Sender, h.Subject, h.Expires, h.Message, strings.Join(h.Results, "\n"))
+	return err
+}
+
+// LookupHeld returns a held message by its token, or nil if not found
+func (b *SQLBackend) LookupHeld(token string) (*list.HeldMessage, error) {
+	h := &list.HeldMessage{
+		Token:   token,
+		Results: []string{},
+	}
+	var results string
+	err := b.db.QueryRow("SELECT list, sender, subject, expires, message, auth_results FROM held_messages WHERE token=?", token).Scan(&h.List, &h.Sender, &h.Subject, &h.Expires, &h.Message, &results)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if results != "" {
+		h.Results = strings.Split(results, "\n")
+	}
+
+	return h, nil
+}
+
+// DeleteHeld method
+func (b *SQLBackend) DeleteHeld(token string) error {
+	_, err := b.db.Exec("DELETE FROM held_messages WHERE token=?", token)
+	return err
+}
+
+// AddReply method
+func (b *SQLBackend) AddReply(address string, date time.Time) error {
+	_, err := b.db.Exec("DELETE FROM replies WHERE date<?", date.Add(-list.ReplyInterval))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec("INSERT INTO replies (address,date) VALUES(?,?)", address, date)
+	return err
+}
+
+// CountReplies method
+func (b *SQLBackend) CountReplies(address string, since time.Time) (int, error) {
+	var n int
+	err := b.db.QueryRow("SELECT COUNT(*) FROM replies WHERE address=? AND date>?", address, since).Scan(&n)
+	return n, err
+}
+
+// ListEnqueue method
+func (b *SQLBackend) ListEnqueue(l list.Definition, q list.QueuedMessage) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO queued_messages (id,list,sender,subject,created,arc_instance,arc_results,arc_chain_validation,message) VALUES(?,?,?,?,?,?,?,?,?)",
+		q.ID, l.Address, q.Sender, q.Subject, q.Created, q.ARCInstance, q.ARCResults, q.ARCChainValidation, q.Message)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, d := range q.Deliveries {
+		_, err = tx.Exec("INSERT INTO queue (id,recipient,status,attempts,next_attempt,error) VALUES(?,?,?,?,?,?)",
+			q.ID, d.Recipient, d.Status, d.Attempts, d.NextAttempt, d.Error)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// Queued returns the queued messages, oldest first
+func (b *SQLBackend) Queued() ([]list.QueuedMessage, error) {
+	rows, err := b.db.Query("SELECT id, list, sender, subject, created, arc_instance, arc_results, arc_chain_validation, message FROM queued_messages ORDER BY created")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []list.QueuedMessage{}
+	defer rows.Close()
+
+	for rows.Next() {
+		q := list.QueuedMessage{}
+		err = rows.Scan(&q.ID, &q.List, &q.Sender, &q.Subject, &q.Created, &q.ARCInstance, &q.ARCResults, &q.ARCChainValidation, &q.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, q)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		result[i].Deliveries, err = b.queuedDeliveries(result[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func (b *SQLBackend) queuedDeliveries(id string) ([]list.QueuedDelivery, error) {
+	rows, err := b.db.Query("SELECT recipient, status, attempts, next_attempt, error FROM queue WHERE id=? ORDER BY recipient", id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []list.QueuedDelivery{}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := list.QueuedDelivery{}
+		err = rows.Scan(&d.Recipient, &d.Status, &d.Attempts, &d.NextAttempt, &d.Error)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+
+	return result, rows.Err()
+}
+
+// UpdateQueued method
+func (b *SQLBackend) UpdateQueued(id string, d list.QueuedDelivery) error {
+	_, err := b.db.Exec("UPDATE queue SET status = ?, attempts = ?, next_attempt = ?, error = ? WHERE id = ? AND recipient = ?",
+		d.Status, d.Attempts, d.NextAttempt, d.Error, id, d.Recipient)
+	return err
+}
+
+// DeleteQueued removes a delivery from the queue, and the message once it has no deliveries left
+func (b *SQLBackend) DeleteQueued(id string, recipient string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM queue WHERE id = ? AND recipient = ?", id, recipient)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM queued_messages WHERE id = ? AND id NOT IN (SELECT id FROM queue)", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// PurgeQueue removes the failed deliveries of messages queued before the given time, and the messages without deliveries
+func (b *SQLBackend) PurgeQueue(before time.Time) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM queue WHERE status = ? AND id IN (SELECT id FROM queued_messages WHERE created < ?)", list.QueueFailed, before)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM queued_messages WHERE id NOT IN (SELECT id FROM queue)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ListArchive method.
+func (b *SQLBackend) ListArchive(l list.Definition, msg *list.Message) error {
+	var (
+		data = []byte(msg.String())
+		id   = fmt.Sprintf("%x", sha256.Sum256(data))
+		now  = time.Now()
+	)
+
+	_, err := b.db.Exec(`INSERT INTO archive (list,id,sender,subject,date,message) VALUES(?,?,?,?,?,?)`,
+		l.Address,
+		id,
+		msg.From,
+		msg.Subject,
+		now,
+		data)
+
+	return err
+}
+
+// ListArchived method
+func (b *SQLBackend) ListArchived(l list.Definition, since time.Time, until time.Time) ([]list.ArchivedMessage, error) {
+	rows, err := b.db.Query("SELECT id, sender, subject, date, message FROM archive WHERE list=? AND date>? AND date<=? ORDER BY date", l.Address, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []list.ArchivedMessage{}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := list.ArchivedMessage{}
+		err = rows.Scan(&m.ID, &m.Sender, &m.Subject, &m.Date, &m.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, m)
+	}
+
+	return result, rows.Err()
+}
+
+// ListLastDigest method
+func (b *SQLBackend) ListLastDigest(l list.Definition) (time.Time, error) {
+	var lastDigest time.Time
+	err := b.db.QueryRow("SELECT last_digest FROM digests WHERE list=?", l.Address).Scan(&lastDigest)
+
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+
+	return lastDigest, err
+}
+
+// ListSetLastDigest method
+func (b *SQLBackend) ListSetLastDigest(l list.Definition, lastDigest time.Time) error {
+	_, err := b.db.Exec("REPLACE INTO digests (list, last_digest) VALUES(?,?)", l.Address, lastDigest)
+	return err
+}
+
+// CreateList method
+func (b *SQLBackend) CreateList(d list.Definition) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO lists (list, name, description, hidden, locked, subscribers_only, moderation, subject_prefix, footer, dmarc_mitigation, dkim_domain, dkim_selector, dkim_key, authenticated, reply_to, reply_to_address, merge_reply_to, archive_url, help_url, owner_url) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		d.Address, d.Name, d.Description, d.Hidden, d.Locked, d.SubscribersOnly, d.Moderation, d.SubjectPrefix, d.Footer, d.DMARCMitigation, d.DKIMDomain, d.DKIMSelector, d.DKIMKey, d.Authenticated, d.ReplyTo, d.ReplyToAddress, d.MergeReplyTo, d.ArchiveURL, d.HelpURL, d.OwnerURL)
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
@@ -455,16 +1209,43 @@ func (b *SQLBackend) CreateList(d list.Definition) error {
 		}
 	}
 
+	for _, address := range d.Owners {
+		if address == "" {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO owners (list, address) VALUES(?,?)", d.Address, address)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, address := range d.Moderators {
+		if address == "" {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO moderators (list, address) VALUES(?,?)", d.Address, address)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	tx.Commit()
 	return nil
 }
 
 // ModifyList method
 func (b *SQLBackend) ModifyList(a string, d list.Definition) error {
-	tx, _ := b.db.Begin()
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
 
-	_, err := tx.Exec("UPDATE lists SET list = ?, name = ?, description = ?, hidden = ?, locked = ?, subscribers_only = ? WHERE list = ?",
-		d.Address, d.Name, d.Description, d.Hidden, d.Locked, d.SubscribersOnly, a)
+	_, err = tx.Exec("UPDATE lists SET list = ?, name = ?, description = ?, hidden = ?, locked = ?, subscribers_only = ?, moderation = ?, subject_prefix = ?, footer = ?, dmarc_mitigation = ?, dkim_domain = ?, dkim_selector = ?, dkim_key = ?, authenticated = ?, reply_to = ?, reply_to_address = ?, merge_reply_to = ?, archive_url = ?, help_url = ?, owner_url = ? WHERE list = ?",
+		d.Address, d.Name, d.Description, d.Hidden, d.Locked, d.SubscribersOnly, d.Moderation, d.SubjectPrefix, d.Footer, d.DMARCMitigation, d.DKIMDomain, d.DKIMSelector, d.DKIMKey, d.Authenticated, d.ReplyTo, d.ReplyToAddress, d.MergeReplyTo, d.ArchiveURL, d.HelpURL, d.OwnerURL, a)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -476,6 +1257,38 @@ func (b *SQLBackend) ModifyList(a string, d list.Definition) error {
 			tx.Rollback()
 			return err
 		}
+
+		// Pending tokens are signed for the old address
+		_, err = tx.Exec("DELETE FROM pending_subscriptions WHERE list = ?", a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE digests SET list = ? WHERE list = ?", d.Address, a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE archive SET list = ? WHERE list = ?", d.Address, a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE queued_messages SET list = ? WHERE list = ?", d.Address, a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// Held tokens are signed for the old address
+		_, err = tx.Exec("DELETE FROM held_messages WHERE list = ?", a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 
 	_, err = tx.Exec("DELETE FROM posters WHERE list = ?", a)
@@ -506,15 +1319,76 @@ func (b *SQLBackend) ModifyList(a string, d list.Definition) error {
 		}
 	}
 
+	_, err = tx.Exec("DELETE FROM owners WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, address := range d.Owners {
+		_, err = tx.Exec("INSERT INTO owners (list, address) VALUES(?,?)", d.Address, address)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM moderators WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, address := range d.Moderators {
+		_, err = tx.Exec("INSERT INTO moderators (list, address) VALUES(?,?)", d.Address, address)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	tx.Commit()
 	return nil
 }
 
 // DeleteList method
 func (b *SQLBackend) DeleteList(a string) error {
-	tx, _ := b.db.Begin()
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM subscriptions WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM pending_subscriptions WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM digests WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM held_messages WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM queue WHERE id IN (SELECT id FROM queued_messages WHERE list = ?)", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	_, err := tx.Exec("DELETE FROM subscriptions WHERE list = ?", a)
+	_, err = tx.Exec("DELETE FROM queued_messages WHERE list = ?", a)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -532,6 +1406,18 @@ func (b *SQLBackend) DeleteList(a string) error {
 		return err
 	}
 
+	_, err = tx.Exec("DELETE FROM owners WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM moderators WHERE list = ?", a)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM lists WHERE list = ?", a)
 	if err != nil {
 		tx.Rollback()